@@ -99,7 +99,7 @@ const ShippingHandling = () => {
         throw new Error(errorData.error);
       }
       const data = await response.json();
-      setProducts(data);
+      setProducts(data.items);
     } catch (error) {
       console.error('Error fetching products:', error);
       toast.error('Error accessing Shipping API', {
@@ -1,24 +1,77 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// allowedOrigins restricts CORS to these origins; empty or containing "*" allows any origin.
+var allowedOrigins []string
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or "" to omit it.
+func allowOrigin(origin string) string {
+	if len(allowedOrigins) == 0 || slices.Contains(allowedOrigins, "*") {
+		return "*"
+	}
+	if origin != "" && slices.Contains(allowedOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+// corsMiddleware answers preflight requests, advertising allow (e.g. "GET, OPTIONS") as the route's methods.
+func corsMiddleware(allow string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*") // be specific domain in production
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		if origin := allowOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if len(allowedOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allow)
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 
 		if r.Method == "OPTIONS" {
+			w.Header().Set("Allow", allow)
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -79,12 +132,43 @@ var (
 		[]string{"endpoint", "category"},
 	)
 
+	shippingFeeDollars = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "shipping_and_handling_shipping_fee_dollars",
+			Help:    "Computed shipping fees in US dollars, before currency conversion",
+			Buckets: []float64{5, 7.5, 10, 12.5, 15, 17.5, 20, 25, 30, 40, 50},
+		},
+		[]string{"category"},
+	)
+
+	feesCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shipping_and_handling_fees_cache_requests_total",
+			Help: "Requests to cached routes by cache outcome (hit, miss or bypass)",
+		},
+		[]string{"cache"},
+	)
+
+	productsTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "shipping_and_handling_products_total",
+			Help: "Current number of products in the catalog",
+		},
+	)
+
 	productNotFoundTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "shipping_and_handling_product_not_found_total",
 			Help: "Number of times a product lookup failed (product not found)",
 		},
 	)
+
+	dedupSharedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "shipping_and_handling_dedup_shared_total",
+			Help: "Number of requests served from a concurrent identical request's result",
+		},
+	)
 )
 
 func init() {
@@ -95,7 +179,13 @@ func init() {
 
 	prometheus.MustRegister(feeCalculationsTotal)
 	prometheus.MustRegister(feeAmount)
+	prometheus.MustRegister(shippingFeeDollars)
+	prometheus.MustRegister(productsTotal)
 	prometheus.MustRegister(productNotFoundTotal)
+	prometheus.MustRegister(dedupSharedTotal)
+	prometheus.MustRegister(feesCacheRequestsTotal)
+
+	productsTotal.Set(float64(len(seedProducts)))
 }
 
 // status + bytes recorder
@@ -146,177 +236,4735 @@ func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// Product represents a product with an ID, name, description, price, and category.
-type Product struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
+// -------- Request logging --------
+// logger writes JSON lines. Debug records carry detail: bodies of routes opted into body logging,
+// the subject of each authenticated request, and fee traces when feeTraceLogging is on.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+type requestIDKey struct{}
+
+// newRequestID returns a random 16-byte hex ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-// products is our in-memory database of products.
-var products = []Product{
-	{ID: 1, Name: "Wireless Bluetooth Headphones", Description: "High-quality sound and comfortable fit", Price: 59.99, Category: "Electronics"},
-	{ID: 2, Name: "Vintage Leather Backpack", Description: "Stylish and durable backpack for everyday use", Price: 89.99, Category: "Accessories"},
-	{ID: 3, Name: "Stainless Steel Water Bottle", Description: "Eco-friendly and leak-proof water bottle", Price: 19.99, Category: "Home & Kitchen"},
-	{ID: 4, Name: "Organic Green Tea", Description: "A refreshing and healthy organic green tea", Price: 15.99, Category: "Groceries"},
-	{ID: 5, Name: "Smartwatch Fitness Tracker", Description: "Track your fitness and stay connected on the go", Price: 199.99, Category: "Electronics"},
-	{ID: 6, Name: "Professional Studio Microphone", Description: "Record high-quality audio with this studio microphone", Price: 129.99, Category: "Electronics"},
-	{ID: 7, Name: "Ergonomic Office Chair", Description: "Stay comfortable while working with this ergonomic chair", Price: 249.99, Category: "Office Supplies"},
-	{ID: 8, Name: "LED Desk Lamp", Description: "Brighten your workspace with this energy-efficient LED lamp", Price: 39.99, Category: "Home & Kitchen"},
-	{ID: 9, Name: "Gourmet Chocolate Box", Description: "Indulge in a variety of gourmet chocolates", Price: 29.99, Category: "Groceries"},
-	{ID: 10, Name: "Yoga Mat with Carrying Strap", Description: "A non-slip yoga mat perfect for all types of yoga", Price: 49.99, Category: "Fitness"},
-	{ID: 11, Name: "Insulated Camping Tent", Description: "A durable and insulated tent for your outdoor adventures", Price: 349.99, Category: "Outdoor"},
-	{ID: 12, Name: "Bluetooth Speaker", Description: "Portable speaker with exceptional sound quality", Price: 99.99, Category: "Electronics"},
-}
-
-// calculateShippingFee calculates the shipping and handling fee based on the category of the product and time of day.
-func calculateShippingFee(category string) float64 {
-	baseFee := 5.0
-	var categoryMultiplier float64
-	timeOfDaySurcharge := 0.0
-	peakHoursStart := 14 // 2 PM
-	peakHoursEnd := 19   // 7 PM
-
-	switch category {
-	case "Electronics":
-		categoryMultiplier = 2.0
-	case "Office Supplies":
-		categoryMultiplier = 1.8
-	case "Home & Kitchen":
-		categoryMultiplier = 1.5
-	case "Groceries":
-		categoryMultiplier = 1.2
-	case "Fitness", "Outdoor":
-		categoryMultiplier = 1.4
-	default:
-		categoryMultiplier = 1.0
+// requestID returns the ID assigned to r by logRequests, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequests assigns each request an ID (reusing the client's X-Request-ID if sent),
+// echoes it in the response and logs one line per request. Metrics stay in instrument.
+func logRequests(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		h(rec, r)
+
+		logger.Info("http request",
+			"request_id", id,
+			"method", r.Method,
+			"route", route,
+			"status_code", rec.statusCode,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
 	}
+}
+
+// Chaos settings inject latency and errors for client resilience testing. They only take effect
+// with CHAOS_ENABLED=true, so a stray CHAOS_* variable can't slow down or break production.
+var (
+	chaosEnabled   bool
+	chaosLatency   time.Duration
+	chaosErrorRate float64 // fraction of requests answered with 500, 0-1
+)
 
-	currentHour := time.Now().Hour()
-	if currentHour >= peakHoursStart && currentHour <= peakHoursEnd {
-		timeOfDaySurcharge = 3.0
+// chaos delays and fails requests as configured; it sits inside withTimeout so injected latency
+// still respects the request timeout.
+func chaos(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !chaosEnabled {
+			h(w, r)
+			return
+		}
+		if chaosLatency > 0 {
+			select {
+			case <-time.After(chaosLatency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if chaosErrorRate > 0 && mrand.Float64() < chaosErrorRate {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "injected chaos error"})
+			return
+		}
+		h(w, r)
 	}
+}
 
-	return baseFee*categoryMultiplier + timeOfDaySurcharge
+// recoverPanics turns a panic in h into a logged stack trace and a 500 JSON error, keeping the server up.
+// It sits inside withTimeout, whose goroutine runs h, and inside instrument so the 500 is recorded.
+func recoverPanics(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			switch p {
+			case nil:
+				return
+			case http.ErrAbortHandler: // net/http's signal to abort the response quietly
+				panic(p)
+			}
+			logger.Error("handler panic",
+				"request_id", requestID(r),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()),
+			)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+		h(w, r)
+	}
 }
 
-// handleShippingFee responds with the calculated shipping fee for a product by its ID.
-func handleShippingFee(w http.ResponseWriter, r *http.Request) {
-	productID := r.URL.Query().Get("product_id")
-	if productID == "" {
-		http.Error(w, "Product ID is required", http.StatusBadRequest)
-		return
+// withHead adds HEAD to an allow list (e.g. "GET, OPTIONS") that permits GET,
+// since net/http serves HEAD through the GET handler and discards the body.
+func withHead(allow string) string {
+	methods := strings.Split(strings.ReplaceAll(allow, " ", ""), ",")
+	if !slices.Contains(methods, http.MethodGet) || slices.Contains(methods, http.MethodHead) {
+		return allow
 	}
+	i := slices.Index(methods, http.MethodGet)
+	return strings.Join(slices.Insert(methods, i+1, http.MethodHead), ", ")
+}
 
-	var product *Product
-	for i := range products {
-		if fmt.Sprintf("%d", products[i].ID) == productID {
-			product = &products[i]
-			break
+// allowMethods rejects methods missing from allow (e.g. "GET, OPTIONS") with 405.
+func allowMethods(allow string, h http.HandlerFunc) http.HandlerFunc {
+	methods := strings.Split(strings.ReplaceAll(allow, " ", ""), ",")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
+		h(w, r)
+	}
+}
+
+// gzipMinSize is the smallest response body worth compressing, in bytes.
+var gzipMinSize = 1024
+
+// gzipResponseWriter buffers the first gzipMinSize bytes to decide whether to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool // headers sent without compression
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
 	}
+}
 
-	if product == nil {
-		productNotFoundTotal.Inc()
-		http.Error(w, "Product not found", http.StatusNotFound)
-		return
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(b)
+	case g.passthrough:
+		return g.ResponseWriter.Write(b)
 	}
 
-	shippingFee := calculateShippingFee(product.Category)
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
 
-	// business metrics
-	feeCalculationsTotal.WithLabelValues("/shipping-fee", product.Category).Inc()
-	feeAmount.WithLabelValues("/shipping-fee", product.Category).Observe(shippingFee)
+// start sends the status and buffered body, compressed unless compress is false
+// or the handler already set its own Content-Encoding.
+func (g *gzipResponseWriter) start(compress bool) error {
+	if g.Header().Get("Content-Encoding") != "" {
+		compress = false
+	}
 
-	response := struct {
-		ID          int     `json:"id"`
-		Name        string  `json:"name"`
-		Description string  `json:"description"`
-		Price       float64 `json:"price"`
-		Category    string  `json:"category"`
-		ShippingFee float64 `json:"shipping_fee"`
-	}{
-		ID:          product.ID,
-		Name:        product.Name,
-		Description: product.Description,
-		Price:       product.Price,
-		Category:    product.Category,
-		ShippingFee: shippingFee,
+	var out io.Writer = g.ResponseWriter
+	if compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		out = g.gz
+	} else {
+		g.passthrough = true
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(response)
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := out.Write(g.buf)
+	g.buf = nil
+	return err
 }
 
-// handleShippingExplanation provides an explanation of shipping fee calculation.
-func handleShippingExplanation(w http.ResponseWriter, r *http.Request) {
-	explanation := map[string]string{
-		"explanation": "The shipping and handling fees are computed by employing a multi-tiered analytical framework. " +
-			"The base fee is dynamically adjusted in accordance with the product's categorical classification. " +
-			"This foundational fee is further compounded by a temporally variable surcharge applied during periods of " +
-			"high demand (peak hours from 2 PM to 7 PM).",
+// close flushes a response that stayed under gzipMinSize, or finishes the gzip stream.
+func (g *gzipResponseWriter) close() error {
+	if g.gz != nil {
+		return g.gz.Close()
 	}
+	if !g.passthrough && g.status != 0 {
+		return g.start(false)
+	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(explanation)
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
 }
 
-func handleAllShippingFees(w http.ResponseWriter, r *http.Request) {
-	var feeDetails []struct {
-		ProductID   int     `json:"product_id"`
-		ShippingFee float64 `json:"shipping_fee"`
-		Price       float64 `json:"price"`
-		Name        string  `json:"name"`
-		Description string  `json:"description"`
-		Category    string  `json:"category"`
+// compress gzip-encodes responses of at least gzipMinSize bytes for clients that accept it.
+func compress(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		h(gw, r)
 	}
+}
 
-	for _, product := range products {
-		fee := calculateShippingFee(product.Category)
+// requestTimeout bounds how long a handler may run before the client gets a 503.
+var requestTimeout = 5 * time.Second
 
-		// business metrics
-		feeCalculationsTotal.WithLabelValues("/all-shipping-fees", product.Category).Inc()
-		feeAmount.WithLabelValues("/all-shipping-fees", product.Category).Observe(fee)
-
-		feeDetails = append(feeDetails, struct {
-			ProductID   int     `json:"product_id"`
-			ShippingFee float64 `json:"shipping_fee"`
-			Price       float64 `json:"price"`
-			Name        string  `json:"name"`
-			Description string  `json:"description"`
-			Category    string  `json:"category"`
-		}{
-			ProductID:   product.ID,
-			ShippingFee: fee,
-			Price:       product.Price,
-			Name:        product.Name,
-			Description: product.Description,
-			Category:    product.Category,
+// withTimeout cancels the request context after requestTimeout and answers 503 if h hasn't finished.
+// It sits inside instrument so timed-out requests are recorded with their 503.
+func withTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.TimeoutHandler(h, requestTimeout, "Request timed out").ServeHTTP(w, r)
+	}
+}
+
+// handle registers h on pattern behind the standard middleware chain; allow lists the methods h serves.
+func handle(pattern, allow string, h http.HandlerFunc) {
+	allow = withHead(allow)
+	// innermost first
+	h = logBodies(pattern, h)
+	h = limitBody(h)
+	h = chaos(h)
+	h = recoverPanics(h)
+	h = withTimeout(h)
+	h = rateLimit(h)
+	h = compress(h)
+	h = allowMethods(allow, h)
+	h = instrument(pattern, h)
+	h = corsMiddleware(allow, h)
+	http.HandleFunc(pattern, logRequests(pattern, h))
+}
+
+// -------- Debug body logging --------
+var (
+	// bodyLogRoutes lists routes whose request/response bodies are logged; empty disables it.
+	bodyLogRoutes  = map[string]bool{}
+	bodyLogMaxSize = 2048
+)
+
+// sensitiveFields are redacted from logged query params and JSON bodies.
+var sensitiveFields = map[string]bool{
+	"authorization": true,
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"api_key":       true,
+	"card_number":   true,
+}
+
+// bodyRecorder keeps a copy of the first max bytes written to the response.
+type bodyRecorder struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+	max int
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	if room := br.max - br.buf.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		br.buf.Write(b[:room])
+	}
+	return br.ResponseWriter.Write(b)
+}
+
+// redactJSON replaces sensitive field values anywhere in a decoded JSON document.
+func redactJSON(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range val {
+			if sensitiveFields[strings.ToLower(k)] {
+				val[k] = "[REDACTED]"
+				continue
+			}
+			val[k] = redactJSON(inner)
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = redactJSON(val[i])
+		}
+	}
+	return v
+}
+
+// sensitiveValuePattern matches "field": "value" pairs for sensitiveFields in
+// bodies that can't be decoded, e.g. because they were cut off at the size cap.
+var sensitiveValuePattern = regexp.MustCompile(`(?i)("(?:authorization|password|token|secret|api_key|card_number)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`)
+
+// redactBody redacts a JSON body and truncates the result to max bytes.
+func redactBody(body []byte, max int) string {
+	var doc interface{}
+	if len(body) > 0 && json.Unmarshal(body, &doc) == nil {
+		if redacted, err := json.Marshal(redactJSON(doc)); err == nil {
+			body = redacted
+		}
+	} else {
+		body = sensitiveValuePattern.ReplaceAll(body, []byte(`$1"[REDACTED]"`))
+	}
+
+	if len(body) > max {
+		return string(body[:max]) + "...(truncated)"
+	}
+	return string(body)
+}
+
+// redactQuery returns the query params with sensitive values masked.
+func redactQuery(r *http.Request) map[string][]string {
+	params := map[string][]string{}
+	for k, v := range r.URL.Query() {
+		if sensitiveFields[strings.ToLower(k)] {
+			params[k] = []string{"[REDACTED]"}
+			continue
+		}
+		params[k] = v
+	}
+	return params
+}
+
+// logBodies logs request params and bodies for routes listed in bodyLogRoutes.
+func logBodies(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !bodyLogRoutes[route] {
+			h(w, r)
+			return
+		}
+
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = io.ReadAll(io.LimitReader(r.Body, int64(bodyLogMaxSize)+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), r.Body))
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, max: bodyLogMaxSize + 1}
+		h(rec, r)
+
+		logger.Debug("http body",
+			"request_id", requestID(r),
+			"method", r.Method,
+			"route", route,
+			"params", redactQuery(r),
+			"request_body", redactBody(reqBody, bodyLogMaxSize),
+			"response_body", redactBody(rec.buf.Bytes(), bodyLogMaxSize),
+		)
+	}
+}
+
+// -------- JSON request bodies --------
+// disallowUnknownFields makes decodeJSON reject body fields the target type doesn't define.
+var disallowUnknownFields = true
+
+// maxBodyBytes caps the request body of write requests; larger bodies are rejected with 413.
+var maxBodyBytes = 1 << 20
+
+// errBodyTooLarge is returned by decodeJSON when the body exceeds maxBodyBytes.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody caps the body of everything but GET, HEAD and OPTIONS requests at maxBodyBytes.
+func limitBody(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodyBytes))
+		}
+		h(w, r)
+	}
+}
+
+// decodeErrorStatus returns the status to answer a decodeJSON error with.
+func decodeErrorStatus(err error) int {
+	if errors.Is(err, errBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// decodeJSON decodes a single JSON value from the request body into dst.
+// The returned error is meant to be sent back to the client with a 400.
+func decodeJSON(r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	if disallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxBytesErr *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesErr):
+			return fmt.Errorf("%w: limit is %d bytes", errBodyTooLarge, maxBytesErr.Limit)
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("invalid JSON: unexpected end of body")
+		case errors.As(err, &typeErr) && typeErr.Field == "":
+			return fmt.Errorf("invalid JSON at offset %d: body must be of type %s", typeErr.Offset, typeErr.Type)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("invalid JSON at offset %d: field %q must be of type %s", typeErr.Offset, typeErr.Field, typeErr.Type)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return fmt.Errorf("invalid JSON: unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		case errors.Is(err, io.EOF):
+			return errors.New("request body must not be empty")
+		default:
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+
+	if dec.More() {
+		return errors.New("request body must contain a single JSON value")
+	}
+	return nil
+}
+
+// -------- Request deduplication --------
+var (
+	dedupEnabled bool
+	dedupGroup   singleflight.Group
+)
+
+// capturedResponse buffers a handler's response so it can be replayed to several clients.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	return c.body.Write(b)
+}
+
+func (c *capturedResponse) WriteHeader(code int) {
+	c.status = code
+}
+
+// dedupe lets concurrent identical GET requests share a single handler run.
+func dedupe(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !dedupEnabled || r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
+
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		v, _, shared := dedupGroup.Do(key, func() (interface{}, error) {
+			resp := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+			h(resp, r)
+			return resp, nil
 		})
+		if shared {
+			dedupSharedTotal.Inc()
+		}
+
+		resp := v.(*capturedResponse)
+		for k, vals := range resp.header {
+			w.Header()[k] = append([]string(nil), vals...)
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(feeDetails)
+// -------- Response caching --------
+// feesCacheTTL is how long a cached /all-shipping-fees response is served.
+var feesCacheTTL = 30 * time.Second
+
+// feesCacheMaxEntries caps cached responses; beyond it, the oldest are evicted before they expire.
+const feesCacheMaxEntries = 1000
+
+type cachedResponse struct {
+	resp    *capturedResponse
+	expires time.Time
 }
 
-func handleHealthz(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status":"ok"}`))
+// cachedKey is an entry in responseCache.order.
+type cachedKey struct {
+	key     string
+	expires time.Time
 }
 
-func main() {
-	// Routes (instrumented + CORS)
-	http.HandleFunc("/shipping-fee", corsMiddleware(instrument("/shipping-fee", handleShippingFee)))
-	http.HandleFunc("/shipping-explanation", corsMiddleware(instrument("/shipping-explanation", handleShippingExplanation)))
-	http.HandleFunc("/all-shipping-fees", corsMiddleware(instrument("/all-shipping-fees", handleAllShippingFees)))
+// responseCache holds successful GET responses keyed by URL and the hour they were computed in.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	// order lists stored responses oldest first; with a fixed TTL that is also expiry order.
+	order []cachedKey
+}
+
+var feesCache = &responseCache{entries: map[string]cachedResponse{}}
+
+func (c *responseCache) get(key string, now time.Time) (*capturedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+// put stores resp under key, then evicts expired responses and, past feesCacheMaxEntries, the oldest ones.
+func (c *responseCache) put(key string, resp *capturedResponse, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := now.Add(feesCacheTTL)
+	c.entries[key] = cachedResponse{resp: resp, expires: expires}
+	c.order = append(c.order, cachedKey{key, expires})
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if now.Before(oldest.expires) && len(c.order) <= feesCacheMaxEntries {
+			break
+		}
+		// the key may have been stored again since; only drop the entry this one stored
+		if entry, ok := c.entries[oldest.key]; ok && entry.expires.Equal(oldest.expires) {
+			delete(c.entries, oldest.key)
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// purge drops every entry; product mutations call it so the catalog is never served stale.
+func (c *responseCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]cachedResponse{}
+	c.order = nil
+}
+
+// feePeriod names the span of time during which time-based surcharges stay the same for t:
+// the hour (weekend, seasonal and dispatch surcharges) and whether it falls in peak hours,
+// whose bounds need not be on the hour.
+func feePeriod(t time.Time) string {
+	period := t.Format("2006-01-02T15")
+	if minute := minuteOfDay(t); minute >= peakHours.Start && minute < peakHours.End {
+		period += " peak"
+	}
+	return period
+}
+
+// cacheResponses serves repeated GETs from cache for up to feesCacheTTL.
+// Fees vary with time (peak, weekend and dispatch surcharges), so entries are keyed by feePeriod
+// and never outlive the period they were computed in.
+func cacheResponses(cache *responseCache, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			feesCacheRequestsTotal.WithLabelValues("bypass").Inc()
+			h(w, r)
+			return
+		}
+
+		now := time.Now()
+		key := feePeriod(localNow()) + " " + r.URL.Path + "?" + r.URL.Query().Encode()
+		resp, hit := cache.get(key, now)
+		if hit {
+			feesCacheRequestsTotal.WithLabelValues("hit").Inc()
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			resp = &capturedResponse{header: http.Header{}, status: http.StatusOK}
+			h(resp, r)
+			if resp.status == http.StatusOK {
+				cache.put(key, resp, now)
+			}
+			feesCacheRequestsTotal.WithLabelValues("miss").Inc()
+			w.Header().Set("X-Cache", "MISS")
+		}
+
+		for k, vals := range resp.header {
+			w.Header()[k] = append([]string(nil), vals...)
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
+	}
+}
+
+// -------- Conditional requests --------
+// etagMatches reports whether an If-None-Match header value matches tag, using weak comparison.
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// withETag tags successful GET responses with a hash of their body and answers
+// 304 Not Modified when the client already holds that version.
+func withETag(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
 
-	// Health + Metrics
-	http.HandleFunc("/healthz", instrument("/healthz", handleHealthz))
-	http.Handle("/metrics", promhttp.Handler())
+		resp := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+		h(resp, r)
+		for k, vals := range resp.header {
+			w.Header()[k] = vals
+		}
+
+		if resp.status == http.StatusOK {
+			sum := sha256.Sum256(resp.body.Bytes())
+			tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", tag)
+			if etagMatches(r.Header.Get("If-None-Match"), tag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Disposition")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 
-	fmt.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
+	}
+}
+
+// -------- Idempotency keys --------
+// idempotencyTTL is how long a replayed Idempotency-Key returns the original response.
+var idempotencyTTL = 24 * time.Hour
+
+// idempotencyMaxKeys caps stored responses; beyond it, the oldest are evicted before they expire.
+const idempotencyMaxKeys = 10000
+
+type idempotentResult struct {
+	bodyHash [sha256.Size]byte
+	resp     *capturedResponse // nil while the first request is still running
+	expires  time.Time
+}
+
+// storedKey is an entry in idempotencyOrder.
+type storedKey struct {
+	key    string
+	result *idempotentResult
+}
+
+var (
+	idempotencyMu   sync.Mutex
+	idempotencyKeys = map[string]*idempotentResult{}
+	// idempotencyOrder lists stored responses oldest first; with a fixed TTL that is also expiry order.
+	idempotencyOrder []storedKey
+)
+
+// storeIdempotentResult records result under key, then evicts expired responses and, past
+// idempotencyMaxKeys, the oldest ones. Callers must hold idempotencyMu.
+func storeIdempotentResult(key string, result *idempotentResult, now time.Time) {
+	idempotencyKeys[key] = result
+	idempotencyOrder = append(idempotencyOrder, storedKey{key, result})
+	for len(idempotencyOrder) > 0 {
+		oldest := idempotencyOrder[0]
+		if now.Before(oldest.result.expires) && len(idempotencyOrder) <= idempotencyMaxKeys {
+			break
+		}
+		// the key may have expired and been reused since; only drop the entry this one stored
+		if idempotencyKeys[oldest.key] == oldest.result {
+			delete(idempotencyKeys, oldest.key)
+		}
+		idempotencyOrder = idempotencyOrder[1:]
+	}
+}
+
+// idempotent replays the first response for a repeated Idempotency-Key instead of running h again.
+// Reusing a key with a different body is rejected with 422, and with one still in progress with 409.
+// Keys are scoped to the caller's JWT subject, method and path, so clients can't collide or replay each other's responses.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientKey := r.Header.Get("Idempotency-Key")
+		if clientKey == "" || r.Method != http.MethodPost {
+			h(w, r)
+			return
+		}
+		key := strings.Join([]string{authSubject(r), r.Method, r.URL.Path, clientKey}, "\x00")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		now := time.Now()
+
+		idempotencyMu.Lock()
+		prior, seen := idempotencyKeys[key]
+		if seen && prior.resp != nil && !now.Before(prior.expires) {
+			seen = false
+		}
+		if !seen {
+			idempotencyKeys[key] = &idempotentResult{bodyHash: hash}
+		}
+		idempotencyMu.Unlock()
+
+		if seen {
+			switch {
+			case prior.bodyHash != hash:
+				http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+			case prior.resp == nil:
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				for k, vals := range prior.resp.header {
+					w.Header()[k] = append([]string(nil), vals...)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(prior.resp.status)
+				_, _ = w.Write(prior.resp.body.Bytes())
+			}
+			return
+		}
+
+		stored := false
+		defer func() {
+			// a failed or panicking request must not leave the key stuck in progress
+			if !stored {
+				idempotencyMu.Lock()
+				delete(idempotencyKeys, key)
+				idempotencyMu.Unlock()
+			}
+		}()
+
+		resp := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+		h(resp, r)
+
+		// let the client retry a failure
+		if resp.status < http.StatusInternalServerError {
+			now := time.Now()
+			idempotencyMu.Lock()
+			storeIdempotentResult(key, &idempotentResult{bodyHash: hash, resp: resp, expires: now.Add(idempotencyTTL)}, now)
+			idempotencyMu.Unlock()
+			stored = true
+		}
+
+		for k, vals := range resp.header {
+			w.Header()[k] = vals
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
+	}
+}
+
+// -------- Rate limiting --------
+var (
+	// rateLimitRPS is the sustained requests per second allowed per client IP; 0 disables limiting.
+	rateLimitRPS float64
+	// rateLimitBurst is how many requests a client may make at once before being throttled.
+	rateLimitBurst = 10
+)
+
+// rateLimitMaxClients caps tracked clients; beyond it, idle full buckets are evicted.
+const rateLimitMaxClients = 10000
+
+// tokenBucket refills at rateLimitRPS tokens per second up to rateLimitBurst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds one token bucket per client IP.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitMaxClients {
+			l.evictIdle(now)
+		}
+		b = &tokenBucket{tokens: float64(rateLimitBurst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rateLimitBurst), b.tokens+now.Sub(b.last).Seconds()*rateLimitRPS)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rateLimitRPS * float64(time.Second))
+}
+
+// evictIdle drops buckets that would have refilled completely by now. Callers must hold l.mu.
+func (l *rateLimiter) evictIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rateLimitRPS >= float64(rateLimitBurst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit rejects clients that exceed rateLimitRPS with 429 and a Retry-After header.
+// Buckets are keyed by clientIP, so only trusted proxies can attribute requests to other addresses;
+// a client rotating its own X-Forwarded-For header still lands in its peer address's bucket.
+func rateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitRPS <= 0 || r.Method == http.MethodOptions {
+			h(w, r)
+			return
+		}
+
+		ok, wait := limiter.allow(clientIP(r).String(), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// -------- Authentication --------
+// jwtSecret is the HMAC key for bearer tokens on write routes; empty rejects all writes.
+var jwtSecret []byte
+
+// jwtClaims holds the registered claims we check; exp is required.
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp *int64 `json:"exp"`
+	Nbf *int64 `json:"nbf"`
+}
+
+// verifyJWT checks an HS256 token's signature and validity window at now.
+func verifyJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("header: %w", err)
+	}
+	if header.Alg != "HS256" {
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return jwtClaims{}, errors.New("invalid signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, fmt.Errorf("claims: %w", err)
+	}
+	if claims.Exp == nil {
+		return jwtClaims{}, errors.New("missing exp claim")
+	}
+	if now.Unix() >= *claims.Exp {
+		return jwtClaims{}, errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Unix() < *claims.Nbf {
+		return jwtClaims{}, errors.New("token not yet valid")
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes one base64url JSON segment of a token into dst.
+func decodeJWTPart(part string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+type authSubjectKey struct{}
+
+// authSubject returns the JWT subject requireAuth verified for r, or "" for unauthenticated requests.
+func authSubject(r *http.Request) string {
+	sub, _ := r.Context().Value(authSubjectKey{}).(string)
+	return sub
+}
+
+// requireAuth demands a valid bearer token for anything but reads, leaving GET routes public.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || len(jwtSecret) == 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := verifyJWT(token, jwtSecret, clock.Now())
+		if err != nil {
+			logger.Info("rejected bearer token", "request_id", requestID(r), "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		logger.Debug("authenticated request", "request_id", requestID(r), "subject", claims.Sub)
+		h(w, r.WithContext(context.WithValue(r.Context(), authSubjectKey{}, claims.Sub)))
+	}
+}
+
+// Product represents a product with an ID, name, description, price, and category.
+type Product struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+	Category    string  `json:"category"`
+	Weight      float64 `json:"weight"` // kilograms
+	Length      float64 `json:"length"` // centimetres
+	Width       float64 `json:"width"`  // centimetres
+	Height      float64 `json:"height"` // centimetres
+	Oversized   bool    `json:"oversized"`
+
+	// StockQuantity is nil for products whose stock isn't tracked, which count as in stock.
+	StockQuantity *int `json:"stock_quantity,omitempty"`
+
+	// Tags are free-form labels such as "fragile" or "hazmat"; see tagSurcharges.
+	Tags []string `json:"tags,omitempty"`
+
+	// WarehouseID is the warehouse that fulfills the product, overriding the requested origin; see fulfillment.
+	WarehouseID string `json:"warehouse_id,omitempty"`
+}
+
+// InStock reports whether p can be shipped now. Out-of-stock products are still quoted, but flagged.
+func (p Product) InStock() bool {
+	return p.StockQuantity == nil || *p.StockQuantity > 0
+}
+
+// intPtr returns a pointer to n, for optional fields such as Product.StockQuantity.
+func intPtr(n int) *int {
+	return &n
+}
+
+// volumetricDivisor converts cm³ to volumetric kilograms, as carriers do.
+var volumetricDivisor = 5000.0
+
+// VolumetricWeight is the product's dimensional weight in kilograms, 0 without dimensions.
+func (p Product) VolumetricWeight() float64 {
+	return p.Length * p.Width * p.Height / volumetricDivisor
+}
+
+// oversizedSide is the longest side, in cm, beyond which a product counts as oversized even if not flagged.
+var oversizedSide = 150.0
+
+// isOversized reports whether p needs the oversized handling surcharge.
+func isOversized(p Product) bool {
+	return p.Oversized || max(p.Length, p.Width, p.Height) > oversizedSide
+}
+
+// chargeableWeight is the greater of actual and volumetric weight, with the basis used:
+// "actual" or "volumetric".
+func chargeableWeight(p Product) (float64, string) {
+	if v := p.VolumetricWeight(); v > p.Weight {
+		return v, "volumetric"
+	}
+	return p.Weight, "actual"
+}
+
+// seedProducts is the built-in catalog used when no other source is configured.
+var seedProducts = []Product{
+	{ID: 1, Name: "Wireless Bluetooth Headphones", Description: "High-quality sound and comfortable fit", Price: 59.99, Category: "Electronics", Weight: 0.3, StockQuantity: intPtr(25)},
+	{ID: 2, Name: "Vintage Leather Backpack", Description: "Stylish and durable backpack for everyday use", Price: 89.99, Category: "Accessories", Weight: 1.2, StockQuantity: intPtr(12)},
+	{ID: 3, Name: "Stainless Steel Water Bottle", Description: "Eco-friendly and leak-proof water bottle", Price: 19.99, Category: "Home & Kitchen", Weight: 0.4, StockQuantity: intPtr(80)},
+	{ID: 4, Name: "Organic Green Tea", Description: "A refreshing and healthy organic green tea", Price: 15.99, Category: "Groceries", Weight: 0.2, StockQuantity: intPtr(40), Tags: []string{"perishable"}},
+	{ID: 5, Name: "Smartwatch Fitness Tracker", Description: "Track your fitness and stay connected on the go", Price: 199.99, Category: "Electronics", Weight: 0.1, StockQuantity: intPtr(18)},
+	{ID: 6, Name: "Professional Studio Microphone", Description: "Record high-quality audio with this studio microphone", Price: 129.99, Category: "Electronics", Weight: 0.8, StockQuantity: intPtr(7), Tags: []string{"fragile"}},
+	{ID: 7, Name: "Ergonomic Office Chair", Description: "Stay comfortable while working with this ergonomic chair", Price: 249.99, Category: "Office Supplies", Weight: 15.0, StockQuantity: intPtr(5)},
+	{ID: 8, Name: "LED Desk Lamp", Description: "Brighten your workspace with this energy-efficient LED lamp", Price: 39.99, Category: "Home & Kitchen", Weight: 1.1, StockQuantity: intPtr(30), Tags: []string{"fragile"}},
+	{ID: 9, Name: "Gourmet Chocolate Box", Description: "Indulge in a variety of gourmet chocolates", Price: 29.99, Category: "Groceries", Weight: 0.5, StockQuantity: intPtr(0), Tags: []string{"perishable"}},
+	{ID: 10, Name: "Yoga Mat with Carrying Strap", Description: "A non-slip yoga mat perfect for all types of yoga", Price: 49.99, Category: "Fitness", Weight: 1.5, StockQuantity: intPtr(22)},
+	{ID: 11, Name: "Insulated Camping Tent", Description: "A durable and insulated tent for your outdoor adventures", Price: 349.99, Category: "Outdoor", Weight: 4.5, Oversized: true, StockQuantity: intPtr(3)},
+	{ID: 12, Name: "Bluetooth Speaker", Description: "Portable speaker with exceptional sound quality", Price: 99.99, Category: "Electronics", Weight: 0.7, StockQuantity: intPtr(15)},
+}
+
+// Money is an amount in integer cents so that summing many fees stays exact.
+// It is converted to a float only when encoded as JSON.
+type Money int64
+
+// MoneyFromFloat converts a dollar amount to Money, rounding to the nearest cent.
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * 100))
+}
+
+// Add returns m + o.
+func (m Money) Add(o Money) Money {
+	return m + o
+}
+
+// Mul scales m by factor, rounding to a whole cent according to roundingMode.
+func (m Money) Mul(factor float64) Money {
+	return roundCents(float64(m) * factor)
+}
+
+// Float returns m in dollars. Since m is a whole number of cents the result
+// never carries more than two decimals, so fee responses need no further rounding.
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+// UnmarshalJSON decodes a dollar amount into m.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*m = MoneyFromFloat(f)
+	return nil
+}
+
+// MarshalJSON encodes m as a dollar amount.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(m.Float(), 'f', -1, 64)), nil
+}
+
+// -------- Rounding --------
+// roundingMode selects how fractional cents in calculated fees are rounded; see roundingModes.
+var roundingMode = "half_up"
+
+var roundingModes = map[string]func(cents float64) float64{
+	"half_up": roundHalfUp,
+	"bankers": roundBankers,
+	"ceil":    roundCeil,
+}
+
+// ceilTolerance absorbs float error so that e.g. 500*1.1 is not rounded up to 551 cents.
+const ceilTolerance = 1e-6
+
+// roundHalfUp rounds to the nearest whole number, with halves going away from zero.
+func roundHalfUp(cents float64) float64 {
+	return math.Round(cents)
+}
+
+// roundBankers rounds to the nearest whole number, with halves going to the even neighbour.
+func roundBankers(cents float64) float64 {
+	return math.RoundToEven(cents)
+}
+
+// roundCeil rounds any fraction up.
+func roundCeil(cents float64) float64 {
+	return math.Ceil(cents - ceilTolerance)
+}
+
+// roundCents rounds a fractional number of cents with the configured rounding mode.
+func roundCents(cents float64) Money {
+	return Money(roundingModes[roundingMode](cents))
+}
+
+// -------- Fee parameters --------
+var (
+	// baseFee is multiplied by the category multiplier before the weight charge and surcharges are added.
+	baseFee   = Money(500)
+	perKgRate = Money(50)
+
+	// weekendSurcharge is added on Saturdays and Sundays in shippingLocation; it stacks with the peak surcharge.
+	weekendSurcharge = Money(0)
+
+	// seasons are date windows with their own surcharge; the first active one applies.
+	seasons []Season
+
+	// oversizedSurcharge is the flat handling charge for bulky products (see isOversized).
+	oversizedSurcharge = Money(800)
+
+	// categoryMultipliers scales the base fee per category; other categories use defaultCategoryMultiplier.
+	categoryMultipliers = map[string]float64{
+		"Electronics":     2.0,
+		"Office Supplies": 1.8,
+		"Home & Kitchen":  1.5,
+		"Groceries":       1.2,
+		"Fitness":         1.4,
+		"Outdoor":         1.4,
+	}
+	// defaultCategoryMultiplier applies to categories missing from categoryMultipliers; raising it
+	// discourages products without proper category metadata.
+	defaultCategoryMultiplier = 1.0
+
+	// categoryFeeLimits bounds the calculated fee per category; categories without an entry are unbounded.
+	categoryFeeLimits = map[string]FeeLimits{}
+
+	// maxTotalFee caps the final quoted fee once every surcharge is added; 0 disables the cap.
+	maxTotalFee = Money(0)
+
+	// handlingFee is charged for picking and packing, itemized apart from shipping. With handlingFeeType
+	// "per_item" every product in a quote pays it; with "flat" only the first one does.
+	handlingFee     = Money(0)
+	handlingFeeType = "per_item"
+
+	// tagSurcharges are flat charges per product tag (lowercase); a product pays one for each distinct tag it has.
+	tagSurcharges = map[string]Money{}
+
+	// categoryRiskSurcharges are flat charges for categories with high damage-claim rates, on top of the multiplier.
+	categoryRiskSurcharges = map[string]Money{}
+)
+
+// Season adds Surcharge to fees on dates from Start to End inclusive, both "YYYY-MM-DD" in shippingLocation.
+type Season struct {
+	Name      string `json:"name"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Surcharge Money  `json:"surcharge"`
+}
+
+// activeSeason returns the first season covering now's date.
+func activeSeason(now time.Time) (Season, bool) {
+	date := now.Format(time.DateOnly)
+	for _, season := range seasons {
+		if date >= season.Start && date <= season.End {
+			return season, true
+		}
+	}
+	return Season{}, false
+}
+
+// FeeLimits clamps a calculated fee to [MinFee, MaxFee]; a zero MaxFee means no ceiling.
+type FeeLimits struct {
+	MinFee Money `json:"min_fee"`
+	MaxFee Money `json:"max_fee"`
+}
+
+// PeakHours is the daily high-demand window [Start, End) during which Surcharge is added.
+type PeakHours struct {
+	Start     int // minutes after midnight, inclusive
+	End       int // minutes after midnight, exclusive
+	Surcharge Money
+}
+
+// minuteOfDay returns the minutes after midnight of t's wall clock.
+func minuteOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// parseTimeOfDay parses an "HH:MM" time, or a bare hour "HH", into minutes after midnight.
+func parseTimeOfDay(raw string) (int, error) {
+	value := raw
+	if !strings.Contains(value, ":") {
+		value += ":00"
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", raw)
+	}
+	return minuteOfDay(t), nil
+}
+
+// shippingLocation is the timezone whose wall clock drives time-of-day pricing.
+var shippingLocation = time.Local
+
+// loadShippingLocation resolves SHIPPING_TIMEZONE, falling back to UTC if it can't be loaded.
+func loadShippingLocation() *time.Location {
+	name := os.Getenv("SHIPPING_TIMEZONE")
+	if name == "" {
+		return time.Local
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("invalid SHIPPING_TIMEZONE %q (%v), using UTC", name, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// Clock supplies the current time to time-dependent pricing.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// clock is swapped for a fixed clock in tests.
+var clock Clock = realClock{}
+
+// localNow returns the clock's current time in shippingLocation.
+func localNow() time.Time {
+	return clock.Now().In(shippingLocation)
+}
+
+// peakHours is set by PEAK_HOURS_START and PEAK_HOURS_END ("HH:MM") and PEAK_SURCHARGE.
+var peakHours = PeakHours{Start: 14 * 60, End: 19 * 60, Surcharge: Money(300)} // 2 PM to 7 PM
+
+// handlingFeeFor returns the handling fee for a product in a quote after charged products already paid theirs.
+func handlingFeeFor(charged int) Money {
+	if handlingFeeType == "flat" && charged > 0 {
+		return 0
+	}
+	return handlingFee
+}
+
+// capTotalFee lowers fee to maxTotalFee if it exceeds it, reporting whether it did.
+func capTotalFee(fee Money) (Money, bool) {
+	if maxTotalFee > 0 && fee > maxTotalFee {
+		return maxTotalFee, true
+	}
+	return fee, false
+}
+
+// categoryMultiplier returns the base-fee multiplier for a category.
+func categoryMultiplier(category string) float64 {
+	if m, ok := categoryMultipliers[category]; ok {
+		return m
+	}
+	return defaultCategoryMultiplier
+}
+
+// FeeBreakdown itemizes a quoted fee. The calculated fee is
+// BaseFee*CategoryMultiplier + WeightCharge + HandlingSurcharge + RiskSurcharge + TagSurcharge + PeakSurcharge + WeekendSurcharge + SeasonalSurcharge = Shipping,
+// and Shipping + HandlingFee = Calculated, unless Clamped says Calculated was raised to the category's minimum ("min")
+// or lowered to its maximum ("max"). TagSurcharges lists the tags that contributed to TagSurcharge.
+// Total is the fee charged: Calculated plus the origin, speed, zone and route surcharges and the request's add-ons, less
+// CouponDiscount, and lowered to maxTotalFee when FeeCapped.
+// The listed amounts are rounded for display; Calculated is rounded once from the unrounded sum.
+type FeeBreakdown struct {
+	BaseFee            Money            `json:"base_fee"`
+	CategoryMultiplier float64          `json:"category_multiplier"`
+	WeightCharge       Money            `json:"weight_charge"`
+	HandlingSurcharge  Money            `json:"handling_surcharge"`
+	RiskSurcharge      Money            `json:"risk_surcharge"`
+	TagSurcharge       Money            `json:"tag_surcharge"`
+	TagSurcharges      map[string]Money `json:"tag_surcharges,omitempty"`
+	PeakSurcharge      Money            `json:"peak_surcharge"`
+	WeekendSurcharge   Money            `json:"weekend_surcharge"`
+	SeasonalSurcharge  Money            `json:"seasonal_surcharge"`
+	Season             string           `json:"season,omitempty"`
+	Shipping           Money            `json:"shipping"`
+	HandlingFee        Money            `json:"handling_fee"`
+	Calculated         Money            `json:"calculated"`
+	Clamped            string           `json:"clamped,omitempty"`
+	OriginSurcharge    Money            `json:"origin_surcharge,omitempty"`
+	SpeedSurcharge     Money            `json:"speed_surcharge,omitempty"`
+	ZoneSurcharge      Money            `json:"zone_surcharge,omitempty"`
+	RouteSurcharge     Money            `json:"route_surcharge,omitempty"`
+	CouponDiscount     Money            `json:"coupon_discount,omitempty"`
+	AgeVerificationFee Money            `json:"age_verification_fee,omitempty"`
+	DispatchSurcharge  Money            `json:"dispatch_surcharge,omitempty"`
+	AppointmentFee     Money            `json:"appointment_fee,omitempty"`
+	CODFee             Money            `json:"cod_fee,omitempty"`
+	SignatureFee       Money            `json:"signature_fee,omitempty"`
+	InsuranceFee       Money            `json:"insurance_fee,omitempty"`
+	Total              Money            `json:"total"`
+	FeeCapped          bool             `json:"fee_capped,omitempty"`
+
+	// Mandatory maps add-on lines charged whether requested or not, such as "insurance_fee", to why.
+	Mandatory map[string]string `json:"mandatory,omitempty"`
+
+	// exactCalculated is Calculated in fractional cents, before rounding; see quoteShipping.
+	exactCalculated float64
+}
+
+// addOn charges amount on top of Total and records it in line.
+func (b *FeeBreakdown) addOn(line *Money, amount Money) {
+	*line = line.Add(amount)
+	b.Total = b.Total.Add(amount)
+}
+
+// mandate notes in Mandatory why the add-on line, named as in JSON, was charged unrequested.
+func (b *FeeBreakdown) mandate(line, reason string) {
+	if b.Mandatory == nil {
+		b.Mandatory = map[string]string{}
+	}
+	b.Mandatory[line] = reason
+}
+
+// Convert returns the breakdown with its amounts converted at rate.
+func (b FeeBreakdown) Convert(rate float64) FeeBreakdown {
+	b.BaseFee = b.BaseFee.Mul(rate)
+	b.WeightCharge = b.WeightCharge.Mul(rate)
+	b.HandlingSurcharge = b.HandlingSurcharge.Mul(rate)
+	b.RiskSurcharge = b.RiskSurcharge.Mul(rate)
+	b.TagSurcharge = b.TagSurcharge.Mul(rate)
+	if b.TagSurcharges != nil {
+		converted := make(map[string]Money, len(b.TagSurcharges))
+		for tag, surcharge := range b.TagSurcharges {
+			converted[tag] = surcharge.Mul(rate)
+		}
+		b.TagSurcharges = converted
+	}
+	b.PeakSurcharge = b.PeakSurcharge.Mul(rate)
+	b.WeekendSurcharge = b.WeekendSurcharge.Mul(rate)
+	b.SeasonalSurcharge = b.SeasonalSurcharge.Mul(rate)
+	b.Shipping = b.Shipping.Mul(rate)
+	b.HandlingFee = b.HandlingFee.Mul(rate)
+	b.Calculated = b.Calculated.Mul(rate)
+	b.OriginSurcharge = b.OriginSurcharge.Mul(rate)
+	b.SpeedSurcharge = b.SpeedSurcharge.Mul(rate)
+	b.ZoneSurcharge = b.ZoneSurcharge.Mul(rate)
+	b.RouteSurcharge = b.RouteSurcharge.Mul(rate)
+	b.CouponDiscount = b.CouponDiscount.Mul(rate)
+	b.AgeVerificationFee = b.AgeVerificationFee.Mul(rate)
+	b.DispatchSurcharge = b.DispatchSurcharge.Mul(rate)
+	b.AppointmentFee = b.AppointmentFee.Mul(rate)
+	b.CODFee = b.CODFee.Mul(rate)
+	b.SignatureFee = b.SignatureFee.Mul(rate)
+	b.InsuranceFee = b.InsuranceFee.Mul(rate)
+	b.Total = b.Total.Mul(rate)
+	return b
+}
+
+// feeStep is one component of a fee, in the order the components are applied, with the fee so far.
+type feeStep struct {
+	Component    string `json:"component"`
+	Amount       Money  `json:"amount"`
+	RunningTotal Money  `json:"running_total"`
+}
+
+// steps lists b's components in the order they are applied, ending at Total. Rounding the
+// calculated fee once, clamping it and capping the total appear as steps of their own when they change it.
+func (b FeeBreakdown) steps() []feeStep {
+	var steps []feeStep
+	var total Money
+	add := func(component string, amount Money) {
+		total = total.Add(amount)
+		steps = append(steps, feeStep{component, amount, total})
+	}
+	adjust := func(component string, to Money) {
+		if to != total {
+			add(component, to-total)
+		}
+	}
+
+	add("base_fee", roundCents(float64(b.BaseFee)*b.CategoryMultiplier))
+	add("weight_charge", b.WeightCharge)
+	add("handling_surcharge", b.HandlingSurcharge)
+	add("risk_surcharge", b.RiskSurcharge)
+	add("tag_surcharge", b.TagSurcharge)
+	add("peak_surcharge", b.PeakSurcharge)
+	add("weekend_surcharge", b.WeekendSurcharge)
+	add("seasonal_surcharge", b.SeasonalSurcharge)
+	add("handling_fee", b.HandlingFee)
+	if b.Clamped != "" {
+		adjust("clamped_"+b.Clamped, b.Calculated)
+	} else {
+		adjust("rounding", b.Calculated)
+	}
+	add("origin_surcharge", b.OriginSurcharge)
+	add("speed_surcharge", b.SpeedSurcharge)
+	add("zone_surcharge", b.ZoneSurcharge)
+	add("route_surcharge", b.RouteSurcharge)
+	add("coupon_discount", -b.CouponDiscount)
+	add("age_verification_fee", b.AgeVerificationFee)
+	add("dispatch_surcharge", b.DispatchSurcharge)
+	add("appointment_fee", b.AppointmentFee)
+	add("cod_fee", b.CODFee)
+	add("signature_fee", b.SignatureFee)
+	add("insurance_fee", b.InsuranceFee)
+	adjust("fee_cap", b.Total)
+	return steps
+}
+
+// feeTraceLogging logs every quoted fee's steps at debug level; see traceFee.
+var feeTraceLogging = false
+
+// traceFee logs how b was reached for the product or item quoted by r, if feeTraceLogging is on,
+// so a quote can be reconstructed from the logs alone.
+func traceFee(r *http.Request, productID int, category string, b FeeBreakdown) {
+	if !feeTraceLogging {
+		return
+	}
+	logger.Debug("fee trace",
+		"request_id", requestID(r),
+		"path", r.URL.Path,
+		"product_id", productID,
+		"category", category,
+		"steps", b.steps(),
+	)
+}
+
+// calculateShippingFee calculates the shipping and handling fee based on the category, weight (kg), size and tags of the product
+// and time of day, adding handling as the handling fee (see handlingFeeFor). now should already be in shippingLocation (see localNow).
+func calculateShippingFee(category string, weight float64, oversized bool, tags []string, handling Money, now time.Time) FeeBreakdown {
+	b := FeeBreakdown{
+		BaseFee:            baseFee,
+		CategoryMultiplier: categoryMultiplier(category),
+		RiskSurcharge:      categoryRiskSurcharges[category],
+		HandlingFee:        handling,
+	}
+
+	// missing, negative or NaN weights contribute nothing
+	var weightCents float64
+	if weight > 0 {
+		weightCents = float64(perKgRate) * weight
+		b.WeightCharge = roundCents(weightCents)
+	}
+	if oversized {
+		b.HandlingSurcharge = oversizedSurcharge
+	}
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		surcharge, ok := tagSurcharges[tag]
+		if _, seen := b.TagSurcharges[tag]; !ok || seen {
+			continue
+		}
+		if b.TagSurcharges == nil {
+			b.TagSurcharges = map[string]Money{}
+		}
+		b.TagSurcharges[tag] = surcharge
+		b.TagSurcharge = b.TagSurcharge.Add(surcharge)
+	}
+
+	if minute := minuteOfDay(now); minute >= peakHours.Start && minute < peakHours.End {
+		b.PeakSurcharge = peakHours.Surcharge
+	}
+	if day := now.Weekday(); day == time.Saturday || day == time.Sunday {
+		b.WeekendSurcharge = weekendSurcharge
+	}
+	if season, ok := activeSeason(now); ok {
+		b.SeasonalSurcharge, b.Season = season.Surcharge, season.Name
+	}
+
+	// sum the fractional cents and round once, rather than rounding every product along the way
+	b.exactCalculated = float64(b.BaseFee)*b.CategoryMultiplier + weightCents +
+		float64(b.HandlingSurcharge+b.RiskSurcharge+b.TagSurcharge+b.PeakSurcharge+b.WeekendSurcharge+b.SeasonalSurcharge+b.HandlingFee)
+	b.Calculated = roundCents(b.exactCalculated)
+	b.Shipping = b.Calculated - b.HandlingFee
+
+	if limits, ok := categoryFeeLimits[category]; ok {
+		switch {
+		case b.Calculated < limits.MinFee:
+			b.Calculated, b.Clamped = limits.MinFee, "min"
+			b.exactCalculated = float64(b.Calculated)
+		case limits.MaxFee > 0 && b.Calculated > limits.MaxFee:
+			b.Calculated, b.Clamped = limits.MaxFee, "max"
+			b.exactCalculated = float64(b.Calculated)
+		}
+	}
+	b.Total = b.Calculated
+	return b
+}
+
+// freeShippingThreshold waives the whole fee, add-ons included, for products priced above it; 0 disables free shipping.
+var freeShippingThreshold = 0.0
+
+// qualifiesForFreeShipping reports whether a product at price ships free.
+func qualifiesForFreeShipping(price float64) bool {
+	return freeShippingThreshold > 0 && price > freeShippingThreshold
+}
+
+// -------- Destination zones --------
+// Zone adjusts the calculated fee for a destination: fee*Multiplier + Surcharge.
+type Zone struct {
+	Multiplier float64 `json:"multiplier"`
+	Surcharge  Money   `json:"surcharge"`
+	ExtraDays  int     `json:"extra_days"`
+}
+
+const defaultZone = "national"
+
+var zones = map[string]Zone{
+	"local":         {Multiplier: 0.8},
+	"national":      {Multiplier: 1.0},
+	"international": {Multiplier: 1.5, Surcharge: Money(1000), ExtraDays: 5},
+}
+
+// -------- Origin warehouses --------
+// Warehouse is an origin products ship from: it scales the calculated fee by Multiplier
+// and adds DispatchDays to delivery estimates.
+type Warehouse struct {
+	Multiplier   float64 `json:"multiplier"`
+	DispatchDays int     `json:"dispatch_days"`
+}
+
+const defaultOrigin = "primary"
+
+var warehouses = map[string]Warehouse{
+	"primary":   {Multiplier: 1.0},
+	"secondary": {Multiplier: 1.15, DispatchDays: 1},
+}
+
+// Route adjusts a quote for shipping from one warehouse to one zone, on top of both:
+// Surcharge is added to the fee and ExtraDays to delivery estimates.
+type Route struct {
+	Surcharge Money `json:"surcharge"`
+	ExtraDays int   `json:"extra_days"`
+}
+
+// routes maps a warehouse and then a zone to the route between them; unlisted routes add nothing.
+var routes = map[string]map[string]Route{}
+
+// fulfillment returns the warehouse product ships from, its WarehouseID if configured or else
+// the requested origin, and the route from there to zone.
+func fulfillment(product Product, requested, zone string) (name string, origin Warehouse, route Route) {
+	name = requested
+	if _, ok := warehouses[product.WarehouseID]; ok {
+		name = product.WarehouseID
+	}
+	return name, warehouses[name], routes[name][zone]
+}
+
+// -------- Delivery speed --------
+// SpeedTier scales the calculated fee for a delivery speed and estimates its transit time.
+type SpeedTier struct {
+	Multiplier   float64 `json:"multiplier"`
+	DeliveryDays int     `json:"delivery_days"`
+	// MinDeliveryDays is the fastest expected transit; zero means DeliveryDays.
+	MinDeliveryDays int `json:"min_delivery_days"`
+}
+
+const defaultSpeed = "standard"
+
+var speedTiers = map[string]SpeedTier{
+	"standard":  {Multiplier: 1.0, DeliveryDays: 5, MinDeliveryDays: 3},
+	"express":   {Multiplier: 1.5, DeliveryDays: 2, MinDeliveryDays: 1},
+	"overnight": {Multiplier: 2.5, DeliveryDays: 1, MinDeliveryDays: 1},
+}
+
+// deliveryWindow estimates the delivery window in days for a speed tier shipped from origin to zone by route.
+func deliveryWindow(speed SpeedTier, zone Zone, origin Warehouse, route Route) (minDays, maxDays int) {
+	minDays, maxDays = speed.MinDeliveryDays, speed.DeliveryDays
+	if minDays <= 0 || minDays > maxDays {
+		minDays = maxDays
+	}
+	extra := zone.ExtraDays + origin.DispatchDays + route.ExtraDays
+	return minDays + extra, maxDays + extra
+}
+
+// -------- Currency --------
+const baseCurrency = "USD"
+
+// currencyRates converts USD amounts into other currencies (units of currency per USD).
+var currencyRates = map[string]float64{
+	"USD": 1,
+	"EUR": 0.92,
+	"GBP": 0.79,
+}
+
+// requestCurrency resolves the currency query parameter, defaulting to USD.
+func requestCurrency(r *http.Request) (code string, rate float64, err error) {
+	code = strings.ToUpper(r.URL.Query().Get("currency"))
+	if code == "" {
+		code = baseCurrency
+	}
+
+	rate, ok := currencyRates[code]
+	if !ok {
+		return "", 0, fmt.Errorf("unsupported currency %q", code)
+	}
+	return code, rate, nil
+}
+
+// currencySymbols are used in formatted amounts; other currencies are written with their code.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// localeFormat is how a locale writes currency amounts.
+type localeFormat struct {
+	decimal     string
+	group       string
+	symbolAfter bool // "1.234,56 €" rather than "€1,234.56"
+}
+
+// localeFormats are the locales accepted by the locale query parameter.
+var localeFormats = map[string]localeFormat{
+	"en-US": {decimal: ".", group: ","},
+	"en-GB": {decimal: ".", group: ","},
+	"de-DE": {decimal: ",", group: ".", symbolAfter: true},
+	"fr-FR": {decimal: ",", group: "\u202f", symbolAfter: true},
+}
+
+// format renders m in currency, e.g. "$1,234.56" for en-US or "1.234,56 €" for de-DE.
+func (f localeFormat) format(m Money, currency string) string {
+	sign, cents := "", int64(m)
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	whole := strconv.FormatInt(cents/100, 10)
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + f.group + whole[i:]
+	}
+	amount := fmt.Sprintf("%s%s%s%02d", sign, whole, f.decimal, cents%100)
+
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = currency
+	}
+	if f.symbolAfter {
+		return amount + "\u00a0" + symbol
+	}
+	return symbol + amount
+}
+
+// roundToCents rounds x to two decimal places.
+func roundToCents(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// convertPrice converts a USD price at rate, rounded to two decimals.
+func convertPrice(price, rate float64) float64 {
+	return roundToCents(price * rate)
+}
+
+// formatTimeOfDay renders minutes after midnight as e.g. "2 PM" or "2:30 PM".
+func formatTimeOfDay(minute int) string {
+	layout := "3:04 PM"
+	if minute%60 == 0 {
+		layout = "3 PM"
+	}
+	return time.Date(0, 1, 1, 0, minute, 0, 0, time.UTC).Format(layout)
+}
+
+// -------- Delivery appointments --------
+var (
+	appointmentFee        = Money(1500)
+	appointmentCategories = map[string]bool{"Office Supplies": true, "Outdoor": true}
+	appointmentZones      = map[string]bool{"local": true, "national": true}
+	appointmentWindows    = []string{"09:00-12:00", "12:00-15:00", "15:00-18:00"}
+)
+
+// -------- Age verification --------
+var (
+	// ageVerificationCategories, and products with any of ageVerificationTags, must be delivered
+	// with age verification, whether requested or not. Tags are matched case-insensitively.
+	ageVerificationCategories = map[string]bool{}
+	ageVerificationTags       = map[string]bool{}
+	ageVerificationFee        = Money(500)
+	// ageVerificationZones and ageVerificationSpeeds are where, and how fast, a courier can check ID on delivery.
+	ageVerificationZones  = map[string]bool{"local": true, "national": true}
+	ageVerificationSpeeds = map[string]bool{"standard": true, "express": true}
+)
+
+// ageVerification reports whether product must be delivered with age verification, and why.
+func ageVerification(product Product) (reason string, required bool) {
+	if ageVerificationCategories[product.Category] {
+		return fmt.Sprintf("category %q requires age verification on delivery", product.Category), true
+	}
+	for _, tag := range product.Tags {
+		if ageVerificationTags[strings.ToLower(tag)] {
+			return fmt.Sprintf("tag %q requires age verification on delivery", tag), true
+		}
+	}
+	return "", false
+}
+
+// ageVerificationProblem returns why age-verified delivery isn't offered to zone at speed, or "" if it is.
+func ageVerificationProblem(zone, speed string) string {
+	if !ageVerificationZones[zone] {
+		return fmt.Sprintf("Age-verified delivery is not available in zone %q", zone)
+	}
+	if !ageVerificationSpeeds[speed] {
+		return fmt.Sprintf("Age-verified delivery is not available at speed %q", speed)
+	}
+	return ""
+}
+
+// -------- Off-hours dispatch --------
+var (
+	// offHoursDispatchSurcharge is added when an order is dispatched on a weekend or outside business hours.
+	offHoursDispatchSurcharge = Money(0)
+	businessHoursStart        = 9  // 9 AM
+	businessHoursEnd          = 17 // 5 PM
+)
+
+// dispatchSurcharge returns the off-hours dispatch surcharge for an order placed at t.
+func dispatchSurcharge(t time.Time) Money {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return offHoursDispatchSurcharge
+	}
+	if t.Hour() < businessHoursStart || t.Hour() >= businessHoursEnd {
+		return offHoursDispatchSurcharge
+	}
+	return 0
+}
+
+// -------- Cash on delivery --------
+var (
+	// codFeeType is "flat" (codFee is an amount) or "percent" (codFee is a percentage of order value).
+	codFeeType = "flat"
+	codFee     = 2.0
+	// codZones are the delivery zones where a courier can collect payment.
+	codZones = map[string]bool{"local": true, "national": true}
+)
+
+// cashOnDeliveryFee returns the COD collection fee for an order of the given value.
+func cashOnDeliveryFee(orderValue float64) Money {
+	if codFeeType == "percent" {
+		return MoneyFromFloat(orderValue * codFee / 100)
+	}
+	return MoneyFromFloat(codFee)
+}
+
+// -------- Insurance and signature --------
+var (
+	// insurancePercent is the optional shipping insurance charge as a percentage of product price.
+	insurancePercent = 1.0
+	// signatureFee is charged for delivery against the recipient's signature.
+	signatureFee = Money(300)
+	// highTheftZones require signature and insurance on every delivery, whether requested or not.
+	highTheftZones = map[string]bool{}
+)
+
+// insuranceFee returns the insurance charge for goods worth price.
+func insuranceFee(price float64) Money {
+	return MoneyFromFloat(price * insurancePercent / 100)
+}
+
+// theftProtection reports whether zone mandates the signature and insurance add-ons, and why.
+func theftProtection(zone string) (reason string, required bool) {
+	if !highTheftZones[zone] {
+		return "", false
+	}
+	return fmt.Sprintf("zone %q requires signature and insurance against package theft", zone), true
+}
+
+// -------- Coupons --------
+// Coupon discounts the shipping fee by Amount dollars ("flat") or Amount percent ("percent").
+type Coupon struct {
+	Type    string    `json:"type"`
+	Amount  float64   `json:"amount"`
+	Expires time.Time `json:"expires,omitempty"` // zero never expires
+}
+
+// coupons maps upper-cased codes to their discount.
+var coupons = map[string]Coupon{}
+
+// lookupCoupon finds an unexpired coupon by code, ignoring case.
+func lookupCoupon(code string, now time.Time) (Coupon, error) {
+	coupon, ok := coupons[strings.ToUpper(code)]
+	if !ok {
+		return Coupon{}, fmt.Errorf("unknown coupon %q", code)
+	}
+	if !coupon.Expires.IsZero() && !now.Before(coupon.Expires) {
+		return Coupon{}, fmt.Errorf("coupon %q has expired", code)
+	}
+	return coupon, nil
+}
+
+// validate checks that c is a flat or percent discount of a sensible amount.
+func (c Coupon) validate() error {
+	switch {
+	case c.Type != "flat" && c.Type != "percent":
+		return errors.New("type must be flat or percent")
+	case c.Amount <= 0:
+		return errors.New("amount must be positive")
+	case c.Type == "percent" && c.Amount > 100:
+		return errors.New("percent amount must not exceed 100")
+	}
+	return nil
+}
+
+// discount returns how much coupon takes off fee, never more than fee itself.
+func (c Coupon) discount(fee Money) Money {
+	d := MoneyFromFloat(c.Amount)
+	if c.Type == "percent" {
+		d = fee.Mul(c.Amount / 100)
+	}
+	return min(d, fee)
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// shippingQuote is a product's fee for an origin, delivery speed and zone, before per-request add-ons.
+type shippingQuote struct {
+	Fee              Money
+	Breakdown        *FeeBreakdown // nil for free shipping
+	FreeShipping     bool
+	OriginSurcharge  Money
+	SpeedSurcharge   Money
+	ZoneSurcharge    Money
+	ChargeableWeight float64
+	WeightBasis      string
+}
+
+// quoteShipping calculates product's fee, including the given handling fee, and applies the origin, speed and zone adjustments to it.
+func quoteShipping(product Product, origin Warehouse, speed SpeedTier, zone Zone, handling Money, now time.Time) shippingQuote {
+	q := shippingQuote{FreeShipping: qualifiesForFreeShipping(product.Price)}
+	q.ChargeableWeight, q.WeightBasis = chargeableWeight(product)
+	if q.FreeShipping {
+		return q
+	}
+
+	b := calculateShippingFee(product.Category, q.ChargeableWeight, isOversized(product), product.Tags, handling, now)
+	q.Breakdown = &b
+
+	// adjust the unrounded fee and round only the final one; each surcharge is
+	// the difference between rounded steps, so Calculated plus the surcharges is still Fee
+	withOrigin := b.exactCalculated * origin.Multiplier
+	withSpeed := withOrigin * speed.Multiplier
+	withZone := withSpeed*zone.Multiplier + float64(zone.Surcharge)
+	q.Fee = roundCents(withZone)
+	q.OriginSurcharge = roundCents(withOrigin) - b.Calculated
+	q.SpeedSurcharge = roundCents(withSpeed) - roundCents(withOrigin)
+	q.ZoneSurcharge = q.Fee - roundCents(withSpeed)
+	b.OriginSurcharge, b.SpeedSurcharge, b.ZoneSurcharge, b.Total = q.OriginSurcharge, q.SpeedSurcharge, q.ZoneSurcharge, q.Fee
+	return q
+}
+
+// feeOptions are the /shipping-fee query parameters shared by single-product and cart quotes.
+type feeOptions struct {
+	Currency   string
+	Rate       float64
+	OriginName string
+	Origin     Warehouse
+	SpeedName  string
+	Speed      SpeedTier
+	ZoneName   string
+	Zone       Zone
+	CouponCode string
+	Coupon     *Coupon // nil without a coupon
+	Now        time.Time
+	Locale     *localeFormat // nil unless formatted amounts were asked for
+}
+
+// parseFeeOptions validates the currency, origin, speed, zone, coupon, at_hour and locale query parameters.
+// Unknown and expired coupons are rejected rather than silently ignored.
+func parseFeeOptions(r *http.Request) (feeOptions, error) {
+	var opts feeOptions
+	var err error
+	if opts.Currency, opts.Rate, err = requestCurrency(r); err != nil {
+		return feeOptions{}, err
+	}
+
+	var ok bool
+	if opts.OriginName = r.URL.Query().Get("origin"); opts.OriginName == "" {
+		opts.OriginName = defaultOrigin
+	}
+	if opts.Origin, ok = warehouses[opts.OriginName]; !ok {
+		return feeOptions{}, fmt.Errorf("unknown origin %q", opts.OriginName)
+	}
+
+	if opts.SpeedName = r.URL.Query().Get("speed"); opts.SpeedName == "" {
+		opts.SpeedName = defaultSpeed
+	}
+	if opts.Speed, ok = speedTiers[opts.SpeedName]; !ok {
+		return feeOptions{}, fmt.Errorf("unknown speed %q", opts.SpeedName)
+	}
+
+	if opts.ZoneName = r.URL.Query().Get("zone"); opts.ZoneName == "" {
+		opts.ZoneName = defaultZone
+	}
+	if opts.Zone, ok = zones[opts.ZoneName]; !ok {
+		return feeOptions{}, fmt.Errorf("unknown zone %q", opts.ZoneName)
+	}
+
+	if opts.CouponCode = r.URL.Query().Get("coupon"); opts.CouponCode != "" {
+		coupon, err := lookupCoupon(opts.CouponCode, clock.Now())
+		if err != nil {
+			return feeOptions{}, err
+		}
+		opts.Coupon = &coupon
+	}
+
+	opts.Now = localNow()
+	// at_hour quotes the fee as if requested at that time today, "HH:MM" or a bare hour, e.g. to show off-peak pricing
+	if raw := r.URL.Query().Get("at_hour"); raw != "" {
+		minute, err := parseTimeOfDay(raw)
+		if err != nil {
+			return feeOptions{}, fmt.Errorf("at_hour: %w", err)
+		}
+		opts.Now = time.Date(opts.Now.Year(), opts.Now.Month(), opts.Now.Day(), minute/60, minute%60, 0, 0, opts.Now.Location())
+	}
+
+	if raw := r.URL.Query().Get("locale"); raw != "" {
+		format, ok := localeFormats[raw]
+		if !ok {
+			return feeOptions{}, fmt.Errorf("unsupported locale %q", raw)
+		}
+		opts.Locale = &format
+	}
+	return opts, nil
+}
+
+// formatted renders an amount already converted to opts.Currency for opts.Locale, or "" without a locale.
+func (opts feeOptions) formatted(m Money) string {
+	if opts.Locale == nil {
+		return ""
+	}
+	return opts.Locale.format(m, opts.Currency)
+}
+
+// bundleDiscountPerItem is taken off a cart's fee for each item after the first, as the shipment
+// is handled once; the discount never exceeds the cart's subtotal.
+var bundleDiscountPerItem = Money(200)
+
+// bundleDiscount returns the discount for shipping count items together with the given subtotal.
+func bundleDiscount(count int, subtotal Money) Money {
+	if count < 2 {
+		return 0
+	}
+	return min(bundleDiscountPerItem*Money(count-1), subtotal)
+}
+
+// cartPricing is how a cart is priced: "sum" quotes each item on its own and adds them up,
+// "dominant" quotes each of its shipments as one package at its dominant category's rate (see combinePackage).
+var cartPricing = "sum"
+
+// combinePackage merges products into one package in the dominant category: the one with the highest
+// multiplier, the earliest in the cart on a tie, shipped from that item's warehouse. The package weighs the items' chargeable weights together,
+// is oversized if any item is, carries every item's tags and is worth their total price.
+func combinePackage(products []Product) Product {
+	var pkg Product
+	for i, p := range products {
+		if i == 0 || categoryMultiplier(p.Category) > categoryMultiplier(pkg.Category) {
+			pkg.Category, pkg.WarehouseID = p.Category, p.WarehouseID
+		}
+		weight, _ := chargeableWeight(p)
+		pkg.Weight += weight
+		pkg.Oversized = pkg.Oversized || isOversized(p)
+		pkg.Tags = append(pkg.Tags, p.Tags...)
+		pkg.Price += p.Price
+	}
+	return pkg
+}
+
+var (
+	// packageMaxItems and packageMaxWeight (chargeable kg) limit one package of a cart; 0 is unlimited.
+	packageMaxItems  = 0
+	packageMaxWeight = 0.0
+)
+
+// splitPackages groups products, in cart order, into packages within packageMaxItems and packageMaxWeight,
+// returning the indices of each package's products and why the cart was split, if it was.
+// A product over packageMaxWeight on its own still gets a package of its own.
+func splitPackages(products []Product) (packages [][]int, reason string) {
+	var current []int
+	var weight float64
+	var byItems, byWeight bool
+	for i, p := range products {
+		w, _ := chargeableWeight(p)
+		fullItems := packageMaxItems > 0 && len(current) >= packageMaxItems
+		fullWeight := packageMaxWeight > 0 && len(current) > 0 && weight+w > packageMaxWeight
+		if fullItems || fullWeight {
+			packages = append(packages, current)
+			current, weight = nil, 0
+			byItems = byItems || fullItems
+			byWeight = byWeight || fullWeight && !fullItems
+		}
+		current = append(current, i)
+		weight += w
+	}
+	if len(current) > 0 {
+		packages = append(packages, current)
+	}
+
+	switch {
+	case byItems && byWeight:
+		reason = fmt.Sprintf("split into %d packages of at most %d items and %g kg", len(packages), packageMaxItems, packageMaxWeight)
+	case byItems:
+		reason = fmt.Sprintf("split into %d packages of at most %d items", len(packages), packageMaxItems)
+	case byWeight:
+		reason = fmt.Sprintf("split into %d packages of at most %g kg", len(packages), packageMaxWeight)
+	}
+	return packages, reason
+}
+
+// handleCartShippingFee quotes several products shipped together, for repeated product_id parameters.
+// The cart is split into shipments by splitPackages. With cartPricing "sum", each item is quoted as on its own
+// and a shipment's subtotal is its item fees, less the bundle discount. With "dominant", it is the fee for the
+// shipment's items combined into one package, itemized as package. The off-hours dispatch surcharge, and in
+// high-theft zones the signature fee, are charged once per shipment with any item quoted without free shipping,
+// and high-theft zones also insure each item. Any coupon comes off the shipments' subtotals, less bundle discounts.
+// Unknown or invalid IDs are reported per item rather than failing the request.
+func handleCartShippingFee(w http.ResponseWriter, r *http.Request, rawIDs []string, opts feeOptions) {
+	for _, param := range []string{"payment_method", "appointment", "insured", "signature"} {
+		if r.URL.Query().Has(param) {
+			http.Error(w, param+" is only supported for a single product_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	type cartItem struct {
+		ID           int           `json:"id"`
+		ShippingFee  *Money        `json:"shipping_fee"`
+		Breakdown    *FeeBreakdown `json:"breakdown,omitempty"`
+		FreeShipping bool          `json:"free_shipping,omitempty"`
+		Warehouse    string        `json:"warehouse,omitempty"`
+		Error        string        `json:"error,omitempty"`
+	}
+
+	items := make([]cartItem, 0, len(rawIDs))
+	var products []Product
+	var quotedItems []int // the index in items of each of products
+	for _, rawID := range rawIDs {
+		id, err := strconv.Atoi(rawID)
+		if err != nil {
+			items = append(items, cartItem{Error: fmt.Sprintf("invalid product ID %q", rawID)})
+			continue
+		}
+		product, err := store.Get(r.Context(), id)
+		if errors.Is(err, errProductNotFound) {
+			productNotFoundTotal.Inc()
+			items = append(items, cartItem{ID: id, Error: "Product not found"})
+			continue
+		}
+		if err != nil {
+			http.Error(w, "Failed to load products", http.StatusInternalServerError)
+			return
+		}
+		products = append(products, product)
+		quotedItems = append(quotedItems, len(items))
+		items = append(items, cartItem{ID: id})
+	}
+	for _, p := range products {
+		if _, required := ageVerification(p); required {
+			if problem := ageVerificationProblem(opts.ZoneName, opts.SpeedName); problem != "" {
+				http.Error(w, fmt.Sprintf("Product %d: %s", p.ID, problem), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+	}
+
+	type cartShipment struct {
+		Items            []int         `json:"items"` // product IDs
+		Warehouse        string        `json:"warehouse,omitempty"`
+		DominantCategory string        `json:"dominant_category,omitempty"`
+		Package          *FeeBreakdown `json:"package,omitempty"`
+
+		Subtotal          Money `json:"subtotal"`
+		BundleDiscount    Money `json:"bundle_discount"`
+		DispatchSurcharge Money `json:"dispatch_surcharge,omitempty"`
+		SignatureFee      Money `json:"signature_fee,omitempty"`
+		Fee               Money `json:"fee"`
+
+		MinDays int `json:"min_days"`
+		MaxDays int `json:"max_days"`
+	}
+
+	theftReason, theftZone := theftProtection(opts.ZoneName)
+	var mandatory map[string]string
+	packages, splitReason := splitPackages(products)
+	shipments := make([]cartShipment, 0, len(packages))
+	handled := 0
+	for _, members := range packages {
+		var shipment cartShipment
+		for _, n := range members {
+			shipment.Items = append(shipment.Items, products[n].ID)
+		}
+		// a shipment arrives with its slowest item
+		widenWindow := func(origin Warehouse, route Route) {
+			lo, hi := deliveryWindow(opts.Speed, opts.Zone, origin, route)
+			shipment.MinDays, shipment.MaxDays = max(shipment.MinDays, lo), max(shipment.MaxDays, hi)
+		}
+		charged := 0
+
+		switch cartPricing {
+		case "dominant":
+			contents := make([]Product, len(members))
+			for k, n := range members {
+				contents[k] = products[n]
+			}
+			pkg := combinePackage(contents)
+			handling := handlingFeeFor(handled)
+			if handlingFeeType == "per_item" {
+				handling = handlingFee * Money(len(contents))
+			}
+			warehouse, origin, route := fulfillment(pkg, opts.OriginName, opts.ZoneName)
+			q := quoteShipping(pkg, origin, opts.Speed, opts.Zone, handling, opts.Now)
+			widenWindow(origin, route)
+			var b FeeBreakdown
+			if q.Breakdown != nil {
+				b = *q.Breakdown
+			}
+			if !q.FreeShipping {
+				charged = len(contents)
+				b.addOn(&b.RouteSurcharge, route.Surcharge)
+				if theftZone {
+					b.addOn(&b.InsuranceFee, insuranceFee(pkg.Price))
+					b.mandate("insurance_fee", theftReason)
+				}
+				for _, p := range contents {
+					// one package needs verifying once
+					if reason, required := ageVerification(p); required {
+						b.addOn(&b.AgeVerificationFee, ageVerificationFee)
+						b.mandate("age_verification_fee", reason)
+						break
+					}
+				}
+			}
+			shipment.Subtotal = b.Total
+			shipment.Warehouse, shipment.DominantCategory = warehouse, pkg.Category
+			traceFee(r, 0, pkg.Category, b)
+			for _, n := range members {
+				items[quotedItems[n]].FreeShipping, items[quotedItems[n]].Warehouse = q.FreeShipping, warehouse
+			}
+			if q.Breakdown != nil {
+				converted := b.Convert(opts.Rate)
+				shipment.Package = &converted
+			}
+
+			// business metrics
+			feeCalculationsTotal.WithLabelValues("/shipping-fee", pkg.Category).Inc()
+			feeAmount.WithLabelValues("/shipping-fee", pkg.Category).Observe(b.Total.Float())
+			shippingFeeDollars.WithLabelValues(pkg.Category).Observe(b.Total.Float())
+		default:
+			for _, n := range members {
+				product := products[n]
+				warehouse, origin, route := fulfillment(product, opts.OriginName, opts.ZoneName)
+				q := quoteShipping(product, origin, opts.Speed, opts.Zone, handlingFeeFor(handled+charged), opts.Now)
+				widenWindow(origin, route)
+				var b FeeBreakdown
+				if q.Breakdown != nil {
+					b = *q.Breakdown
+				}
+				if !q.FreeShipping {
+					charged++
+					b.addOn(&b.RouteSurcharge, route.Surcharge)
+					if theftZone {
+						b.addOn(&b.InsuranceFee, insuranceFee(product.Price))
+						b.mandate("insurance_fee", theftReason)
+					}
+					if reason, required := ageVerification(product); required {
+						b.addOn(&b.AgeVerificationFee, ageVerificationFee)
+						b.mandate("age_verification_fee", reason)
+					}
+				}
+				fee := b.Total
+				shipment.Subtotal = shipment.Subtotal.Add(fee)
+				traceFee(r, product.ID, product.Category, b)
+
+				// business metrics
+				feeCalculationsTotal.WithLabelValues("/shipping-fee", product.Category).Inc()
+				feeAmount.WithLabelValues("/shipping-fee", product.Category).Observe(fee.Float())
+				shippingFeeDollars.WithLabelValues(product.Category).Observe(fee.Float())
+
+				item := &items[quotedItems[n]]
+				item.FreeShipping, item.Warehouse = q.FreeShipping, warehouse
+				converted := fee.Mul(opts.Rate)
+				item.ShippingFee = &converted
+				if q.Breakdown != nil {
+					converted := b.Convert(opts.Rate)
+					item.Breakdown = &converted
+				}
+			}
+			// a combined package is already priced as one shipment
+			shipment.BundleDiscount = bundleDiscount(len(members), shipment.Subtotal)
+		}
+
+		if charged > 0 {
+			// nothing is charged for if every item in the shipment ships free
+			shipment.DispatchSurcharge = dispatchSurcharge(opts.Now)
+			if theftZone {
+				// one signature covers the shipment
+				shipment.SignatureFee = signatureFee
+				mandatory = map[string]string{"signature_fee": theftReason}
+			}
+		}
+		handled += charged
+		shipment.Fee = shipment.Subtotal - shipment.BundleDiscount + shipment.DispatchSurcharge + shipment.SignatureFee
+		shipments = append(shipments, shipment)
+	}
+
+	var subtotal, bundle, dispatchFee, signature Money
+	var minDays, maxDays int
+	for _, shipment := range shipments {
+		subtotal = subtotal.Add(shipment.Subtotal)
+		bundle = bundle.Add(shipment.BundleDiscount)
+		dispatchFee = dispatchFee.Add(shipment.DispatchSurcharge)
+		signature = signature.Add(shipment.SignatureFee)
+		// the cart arrives with its slowest shipment
+		minDays, maxDays = max(minDays, shipment.MinDays), max(maxDays, shipment.MaxDays)
+	}
+	if len(shipments) == 0 {
+		minDays, maxDays = deliveryWindow(opts.Speed, opts.Zone, opts.Origin, routes[opts.OriginName][opts.ZoneName])
+	}
+	total := subtotal - bundle
+	var couponDiscount Money
+	if opts.Coupon != nil {
+		couponDiscount = opts.Coupon.discount(total)
+		total -= couponDiscount
+	}
+	total, feeCapped := capTotalFee(total.Add(dispatchFee).Add(signature))
+
+	for i := range shipments {
+		shipment := &shipments[i]
+		shipment.Subtotal = shipment.Subtotal.Mul(opts.Rate)
+		shipment.BundleDiscount = shipment.BundleDiscount.Mul(opts.Rate)
+		shipment.DispatchSurcharge = shipment.DispatchSurcharge.Mul(opts.Rate)
+		shipment.SignatureFee = shipment.SignatureFee.Mul(opts.Rate)
+		shipment.Fee = shipment.Fee.Mul(opts.Rate)
+	}
+
+	response := struct {
+		Items    []cartItem `json:"items"`
+		Currency string     `json:"currency"`
+
+		PricingMode string         `json:"pricing_mode"`
+		Shipments   []cartShipment `json:"shipments"`
+		SplitReason string         `json:"split_reason,omitempty"`
+
+		Origin string `json:"origin"`
+		Speed  string `json:"speed"`
+		Zone   string `json:"zone"`
+
+		EstimatedDeliveryDays int `json:"estimated_delivery_days"`
+		MinDays               int `json:"min_days"`
+		MaxDays               int `json:"max_days"`
+
+		Subtotal       Money `json:"subtotal"`
+		BundleDiscount Money `json:"bundle_discount"`
+
+		Coupon         string `json:"coupon,omitempty"`
+		CouponDiscount Money  `json:"coupon_discount,omitempty"`
+
+		DispatchSurcharge Money             `json:"dispatch_surcharge,omitempty"`
+		SignatureFee      Money             `json:"signature_fee,omitempty"`
+		Mandatory         map[string]string `json:"mandatory,omitempty"`
+		Total             Money             `json:"total"`
+		FormattedTotal    string            `json:"formatted_total,omitempty"`
+		FeeCapped         bool              `json:"fee_capped,omitempty"`
+	}{
+		Items:    items,
+		Currency: opts.Currency,
+
+		PricingMode: cartPricing,
+		Shipments:   shipments,
+		SplitReason: splitReason,
+
+		Origin: opts.OriginName,
+		Speed:  opts.SpeedName,
+		Zone:   opts.ZoneName,
+
+		EstimatedDeliveryDays: maxDays,
+		MinDays:               minDays,
+		MaxDays:               maxDays,
+
+		Subtotal:       subtotal.Mul(opts.Rate),
+		BundleDiscount: bundle.Mul(opts.Rate),
+
+		Coupon:         strings.ToUpper(opts.CouponCode),
+		CouponDiscount: couponDiscount.Mul(opts.Rate),
+
+		DispatchSurcharge: dispatchFee.Mul(opts.Rate),
+		SignatureFee:      signature.Mul(opts.Rate),
+		Mandatory:         mandatory,
+		Total:             total.Mul(opts.Rate),
+		FormattedTotal:    opts.formatted(total.Mul(opts.Rate)),
+		FeeCapped:         feeCapped,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// handleShippingFee responds with the calculated shipping fee for a product by its ID,
+// or for a cart when product_id is repeated (see handleCartShippingFee).
+func handleShippingFee(w http.ResponseWriter, r *http.Request) {
+	rawIDs := r.URL.Query()["product_id"]
+	if len(rawIDs) == 0 || rawIDs[0] == "" {
+		http.Error(w, "Product ID is required", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseFeeOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(rawIDs) > 1 {
+		handleCartShippingFee(w, r, rawIDs, opts)
+		return
+	}
+	writeShippingFee(w, r, rawIDs[0], opts)
+}
+
+// handleProductShippingFee is the path-style form of handleShippingFee for a single product,
+// /products/{id}/shipping-fee, accepting the same query options.
+func handleProductShippingFee(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseFeeOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeShippingFee(w, r, r.PathValue("id"), opts)
+}
+
+// writeShippingFee responds with the shipping fee quote for the product with ID rawID.
+func writeShippingFee(w http.ResponseWriter, r *http.Request, rawID string, opts feeOptions) {
+	productID, err := strconv.Atoi(rawID)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := store.Get(r.Context(), productID)
+	if errors.Is(err, errProductNotFound) {
+		productNotFoundTotal.Inc()
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	warehouse, origin, route := fulfillment(product, opts.OriginName, opts.ZoneName)
+	q := quoteShipping(product, origin, opts.Speed, opts.Zone, handlingFee, opts.Now)
+	var b FeeBreakdown
+	if q.Breakdown != nil {
+		b = *q.Breakdown
+	}
+	b.addOn(&b.RouteSurcharge, route.Surcharge)
+
+	if opts.Coupon != nil {
+		b.CouponDiscount = opts.Coupon.discount(b.Total)
+		b.Total -= b.CouponDiscount
+	}
+
+	ageReason, ageRequired := ageVerification(product)
+	if ageRequired {
+		if problem := ageVerificationProblem(opts.ZoneName, opts.SpeedName); problem != "" {
+			http.Error(w, problem, http.StatusUnprocessableEntity)
+			return
+		}
+		b.addOn(&b.AgeVerificationFee, ageVerificationFee)
+		b.mandate("age_verification_fee", ageReason)
+	}
+	b.addOn(&b.DispatchSurcharge, dispatchSurcharge(opts.Now))
+
+	paymentMethod := r.URL.Query().Get("payment_method")
+	switch paymentMethod {
+	case "", "prepaid":
+	case "cod":
+		if !codZones[opts.ZoneName] {
+			http.Error(w, fmt.Sprintf("Cash on delivery is not available in zone %q", opts.ZoneName), http.StatusUnprocessableEntity)
+			return
+		}
+		b.addOn(&b.CODFee, cashOnDeliveryFee(product.Price))
+	default:
+		http.Error(w, "payment_method must be prepaid or cod", http.StatusBadRequest)
+		return
+	}
+
+	var apptWindows []string
+	if r.URL.Query().Get("appointment") == "true" {
+		if !appointmentCategories[product.Category] {
+			http.Error(w, "Appointment delivery is not available for this category", http.StatusUnprocessableEntity)
+			return
+		}
+		if !appointmentZones[opts.ZoneName] {
+			http.Error(w, fmt.Sprintf("Appointment delivery is not available in zone %q", opts.ZoneName), http.StatusUnprocessableEntity)
+			return
+		}
+		apptWindows = appointmentWindows
+		b.addOn(&b.AppointmentFee, appointmentFee)
+	}
+
+	signature := r.URL.Query().Get("signature") == "true"
+	insured := r.URL.Query().Get("insured") == "true"
+	if reason, required := theftProtection(opts.ZoneName); required {
+		signature, insured = true, true
+		b.mandate("signature_fee", reason)
+		b.mandate("insurance_fee", reason)
+	}
+	if signature {
+		b.addOn(&b.SignatureFee, signatureFee)
+	}
+	if insured {
+		b.addOn(&b.InsuranceFee, insuranceFee(product.Price))
+	}
+
+	if q.FreeShipping {
+		// free shipping waives the add-ons too, once the request has passed their eligibility checks
+		b = FeeBreakdown{}
+	}
+	b.Total, b.FeeCapped = capTotalFee(b.Total)
+	shippingFee, feeCapped := b.Total, b.FeeCapped
+	traceFee(r, product.ID, product.Category, b)
+
+	var collectAmount Money
+	if paymentMethod == "cod" {
+		collectAmount = shippingFee.Add(MoneyFromFloat(product.Price))
+	}
+
+	// business metrics
+	feeCalculationsTotal.WithLabelValues("/shipping-fee", product.Category).Inc()
+	feeAmount.WithLabelValues("/shipping-fee", product.Category).Observe(shippingFee.Float())
+	shippingFeeDollars.WithLabelValues(product.Category).Observe(shippingFee.Float())
+
+	minDays, maxDays := deliveryWindow(opts.Speed, opts.Zone, origin, route)
+	response := struct {
+		ID          int     `json:"id"`
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		Price       float64 `json:"price"`
+		Category    string  `json:"category"`
+		Weight      float64 `json:"weight"`
+		ShippingFee Money   `json:"shipping_fee"`
+		Currency    string  `json:"currency"`
+
+		FormattedFee string `json:"formatted_fee,omitempty"`
+		InStock      bool   `json:"in_stock"`
+
+		ChargeableWeight float64 `json:"chargeable_weight"`
+		WeightBasis      string  `json:"weight_basis"`
+
+		Breakdown    *FeeBreakdown `json:"breakdown,omitempty"`
+		FreeShipping bool          `json:"free_shipping"`
+
+		Origin          string `json:"origin"`
+		Warehouse       string `json:"warehouse"`
+		OriginSurcharge Money  `json:"origin_surcharge"`
+
+		Speed                 string `json:"speed"`
+		SpeedSurcharge        Money  `json:"speed_surcharge"`
+		EstimatedDeliveryDays int    `json:"estimated_delivery_days"`
+		MinDays               int    `json:"min_days"`
+		MaxDays               int    `json:"max_days"`
+
+		Zone          string `json:"zone"`
+		ZoneSurcharge Money  `json:"zone_surcharge"`
+
+		Coupon         string `json:"coupon,omitempty"`
+		CouponDiscount Money  `json:"coupon_discount,omitempty"`
+
+		AppointmentWindows []string `json:"appointment_windows,omitempty"`
+
+		DispatchSurcharge Money `json:"dispatch_surcharge,omitempty"`
+
+		CollectAmount Money `json:"collect_amount,omitempty"`
+
+		FeeCapped bool `json:"fee_capped,omitempty"`
+
+		AgeVerificationFee      Money  `json:"age_verification_fee,omitempty"`
+		AgeVerificationRequired bool   `json:"age_verification_required,omitempty"`
+		AgeVerificationReason   string `json:"age_verification_reason,omitempty"`
+	}{
+		ID:          product.ID,
+		Name:        product.Name,
+		Description: product.Description,
+		Price:       convertPrice(product.Price, opts.Rate),
+		Category:    product.Category,
+		Weight:      product.Weight,
+		ShippingFee: shippingFee.Mul(opts.Rate),
+		Currency:    opts.Currency,
+
+		FormattedFee: opts.formatted(shippingFee.Mul(opts.Rate)),
+		InStock:      product.InStock(),
+
+		ChargeableWeight: q.ChargeableWeight,
+		WeightBasis:      q.WeightBasis,
+
+		FreeShipping: q.FreeShipping,
+
+		Origin:          opts.OriginName,
+		Warehouse:       warehouse,
+		OriginSurcharge: q.OriginSurcharge.Mul(opts.Rate),
+
+		Speed:                 opts.SpeedName,
+		SpeedSurcharge:        q.SpeedSurcharge.Mul(opts.Rate),
+		EstimatedDeliveryDays: maxDays,
+		MinDays:               minDays,
+		MaxDays:               maxDays,
+
+		Zone:          opts.ZoneName,
+		ZoneSurcharge: q.ZoneSurcharge.Mul(opts.Rate),
+
+		Coupon:         strings.ToUpper(opts.CouponCode),
+		CouponDiscount: b.CouponDiscount.Mul(opts.Rate),
+
+		AppointmentWindows: apptWindows,
+
+		DispatchSurcharge: b.DispatchSurcharge.Mul(opts.Rate),
+
+		CollectAmount: collectAmount.Mul(opts.Rate),
+
+		FeeCapped: feeCapped,
+
+		AgeVerificationFee:      b.AgeVerificationFee.Mul(opts.Rate),
+		AgeVerificationRequired: ageRequired,
+		AgeVerificationReason:   ageReason,
+	}
+	if q.Breakdown != nil {
+		converted := b.Convert(opts.Rate)
+		response.Breakdown = &converted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+var (
+	// estimateMissingPrice is what /estimate does without a price: "skip" the price-dependent
+	// components (free shipping and insurance), "require" one, or "assume" estimateAssumedPrice.
+	estimateMissingPrice = "skip"
+	estimateAssumedPrice = 0.0
+)
+
+// handleEstimate quotes the fee for an ad-hoc item described in the JSON body, without a stored product.
+// Without a price, it follows estimateMissingPrice and lists any components it skipped.
+func handleEstimate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Category  string   `json:"category"`
+		Price     *float64 `json:"price"`
+		Weight    float64  `json:"weight"`
+		Length    float64  `json:"length"`
+		Width     float64  `json:"width"`
+		Height    float64  `json:"height"`
+		Tags      []string `json:"tags"`
+		Origin    string   `json:"origin"`
+		Zone      string   `json:"zone"`
+		Speed     string   `json:"speed"`
+		Insured   bool     `json:"insured"`
+		Signature bool     `json:"signature"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+
+	if req.Zone == "" {
+		req.Zone = defaultZone
+	}
+	theftReason, theftZone := theftProtection(req.Zone)
+	if theftZone {
+		req.Signature, req.Insured = true, true
+	}
+
+	var price float64
+	var priceAssumed bool
+	var skipped []string
+	switch {
+	case req.Price != nil:
+		price = *req.Price
+	case estimateMissingPrice == "require":
+		http.Error(w, "price is required", http.StatusBadRequest)
+		return
+	case estimateMissingPrice == "assume":
+		price, priceAssumed = estimateAssumedPrice, true
+	default:
+		skipped = append(skipped, "free_shipping")
+		if req.Insured {
+			skipped = append(skipped, "insurance")
+		}
+	}
+
+	currency, rate, err := requestCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Origin == "" {
+		req.Origin = defaultOrigin
+	}
+	if req.Speed == "" {
+		req.Speed = defaultSpeed
+	}
+	origin, originOK := warehouses[req.Origin]
+	speed, speedOK := speedTiers[req.Speed]
+	zone, zoneOK := zones[req.Zone]
+
+	var problem string
+	switch {
+	case req.Category == "":
+		problem = "category is required"
+	case !isKnownCategory(req.Category):
+		problem = fmt.Sprintf("unknown category %q", req.Category)
+	case price < 0 || req.Weight < 0:
+		problem = "price and weight must not be negative"
+	case req.Length < 0 || req.Width < 0 || req.Height < 0:
+		problem = "dimensions must not be negative"
+	case !originOK:
+		problem = fmt.Sprintf("unknown origin %q", req.Origin)
+	case !speedOK:
+		problem = fmt.Sprintf("unknown speed %q", req.Speed)
+	case !zoneOK:
+		problem = fmt.Sprintf("unknown zone %q", req.Zone)
+	}
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	item := Product{
+		Category: req.Category,
+		Price:    price,
+		Weight:   req.Weight,
+		Length:   req.Length,
+		Width:    req.Width,
+		Height:   req.Height,
+		Tags:     req.Tags,
+	}
+	ageReason, ageRequired := ageVerification(item)
+	if ageRequired {
+		if problem := ageVerificationProblem(req.Zone, req.Speed); problem != "" {
+			http.Error(w, problem, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	now := localNow()
+	q := quoteShipping(item, origin, speed, zone, handlingFee, now)
+	var b FeeBreakdown
+	if q.Breakdown != nil {
+		b = *q.Breakdown
+	}
+	route := routes[req.Origin][req.Zone]
+	if !q.FreeShipping {
+		b.addOn(&b.RouteSurcharge, route.Surcharge)
+		if ageRequired {
+			b.addOn(&b.AgeVerificationFee, ageVerificationFee)
+			b.mandate("age_verification_fee", ageReason)
+		}
+		b.addOn(&b.DispatchSurcharge, dispatchSurcharge(now))
+		if req.Signature {
+			b.addOn(&b.SignatureFee, signatureFee)
+		}
+		if req.Insured && skipped == nil {
+			b.addOn(&b.InsuranceFee, insuranceFee(item.Price))
+		}
+		if theftZone {
+			b.mandate("signature_fee", theftReason)
+			if skipped == nil {
+				b.mandate("insurance_fee", theftReason)
+			}
+		}
+	}
+	b.Total, b.FeeCapped = capTotalFee(b.Total)
+	shippingFee, feeCapped := b.Total, b.FeeCapped
+	traceFee(r, 0, item.Category, b)
+	minDays, maxDays := deliveryWindow(speed, zone, origin, route)
+
+	// business metrics
+	feeCalculationsTotal.WithLabelValues("/estimate", item.Category).Inc()
+	feeAmount.WithLabelValues("/estimate", item.Category).Observe(shippingFee.Float())
+	shippingFeeDollars.WithLabelValues(item.Category).Observe(shippingFee.Float())
+
+	response := struct {
+		Category    string  `json:"category"`
+		Price       float64 `json:"price"`
+		Weight      float64 `json:"weight"`
+		ShippingFee Money   `json:"shipping_fee"`
+		Currency    string  `json:"currency"`
+
+		PriceAssumed      bool     `json:"price_assumed,omitempty"`
+		SkippedComponents []string `json:"skipped_components,omitempty"`
+
+		ChargeableWeight float64 `json:"chargeable_weight"`
+		WeightBasis      string  `json:"weight_basis"`
+
+		Breakdown    *FeeBreakdown `json:"breakdown,omitempty"`
+		FreeShipping bool          `json:"free_shipping"`
+
+		Origin          string `json:"origin"`
+		OriginSurcharge Money  `json:"origin_surcharge"`
+
+		Speed                 string `json:"speed"`
+		SpeedSurcharge        Money  `json:"speed_surcharge"`
+		EstimatedDeliveryDays int    `json:"estimated_delivery_days"`
+		MinDays               int    `json:"min_days"`
+		MaxDays               int    `json:"max_days"`
+
+		Zone          string `json:"zone"`
+		ZoneSurcharge Money  `json:"zone_surcharge"`
+
+		DispatchSurcharge Money `json:"dispatch_surcharge,omitempty"`
+
+		AgeVerificationFee      Money  `json:"age_verification_fee,omitempty"`
+		AgeVerificationRequired bool   `json:"age_verification_required,omitempty"`
+		AgeVerificationReason   string `json:"age_verification_reason,omitempty"`
+
+		FeeCapped bool `json:"fee_capped,omitempty"`
+	}{
+		Category:    item.Category,
+		Price:       convertPrice(item.Price, rate),
+		Weight:      item.Weight,
+		ShippingFee: shippingFee.Mul(rate),
+		Currency:    currency,
+
+		PriceAssumed:      priceAssumed,
+		SkippedComponents: skipped,
+
+		ChargeableWeight: q.ChargeableWeight,
+		WeightBasis:      q.WeightBasis,
+
+		FreeShipping: q.FreeShipping,
+
+		Origin:          req.Origin,
+		OriginSurcharge: q.OriginSurcharge.Mul(rate),
+
+		Speed:                 req.Speed,
+		SpeedSurcharge:        q.SpeedSurcharge.Mul(rate),
+		EstimatedDeliveryDays: maxDays,
+		MinDays:               minDays,
+		MaxDays:               maxDays,
+
+		Zone:          req.Zone,
+		ZoneSurcharge: q.ZoneSurcharge.Mul(rate),
+
+		DispatchSurcharge: b.DispatchSurcharge.Mul(rate),
+
+		AgeVerificationFee:      b.AgeVerificationFee.Mul(rate),
+		AgeVerificationRequired: ageRequired,
+		AgeVerificationReason:   ageReason,
+
+		FeeCapped: feeCapped,
+	}
+	if q.Breakdown != nil {
+		converted := b.Convert(rate)
+		response.Breakdown = &converted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// handleShippingExplanation provides an explanation of shipping fee calculation.
+func handleShippingExplanation(w http.ResponseWriter, r *http.Request) {
+	categories := make([]string, 0, len(categoryMultipliers))
+	for category := range categoryMultipliers {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	rates := make([]string, 0, len(categories)+1)
+	for _, category := range categories {
+		rates = append(rates, fmt.Sprintf("%s x%g", category, categoryMultipliers[category]))
+	}
+	rates = append(rates, fmt.Sprintf("all other categories x%g", defaultCategoryMultiplier))
+
+	text := "The shipping and handling fees are computed by employing a multi-tiered analytical framework. " +
+		fmt.Sprintf("The base fee of $%.2f is dynamically adjusted in accordance with the product's categorical classification (%s). ",
+			baseFee.Float(), strings.Join(rates, ", ")) +
+		fmt.Sprintf("This foundational fee is further compounded by a temporally variable surcharge of $%.2f applied during periods of "+
+			"high demand (peak hours from %s to %s).", peakHours.Surcharge.Float(), formatTimeOfDay(peakHours.Start), formatTimeOfDay(peakHours.End))
+	if weekendSurcharge > 0 {
+		text += fmt.Sprintf(" A further weekend surcharge of $%.2f applies on Saturdays and Sundays.", weekendSurcharge.Float())
+	}
+	if handlingFee > 0 {
+		per := "per item"
+		if handlingFeeType == "flat" {
+			per = "per shipment"
+		}
+		text += fmt.Sprintf(" A handling fee of $%.2f %s is itemized separately from shipping.", handlingFee.Float(), per)
+	}
+	explanation := map[string]string{"explanation": text}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(explanation)
+}
+
+// handleCategories lists the distinct categories in the catalog with the multiplier
+// calculateShippingFee applies to each, sorted by name.
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	catalog, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	names := []string{}
+	for _, product := range catalog {
+		if !slices.Contains(names, product.Category) {
+			names = append(names, product.Category)
+		}
+	}
+	sort.Strings(names)
+
+	type category struct {
+		Name       string  `json:"name"`
+		Multiplier float64 `json:"multiplier"`
+	}
+	categories := make([]category, 0, len(names))
+	for _, name := range names {
+		categories = append(categories, category{Name: name, Multiplier: categoryMultiplier(name)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(categories)
+}
+
+// listedShippingFee is the fee quoted for a product without any per-request options, shipped
+// by the default speed to the default zone from the product's warehouse or the default origin:
+// the quoted fee, less coupon's discount if coupon isn't nil, plus mandatory age verification
+// and off-hours dispatch surcharges, capped at maxTotalFee, or 0 for free shipping.
+func listedShippingFee(product Product, now time.Time, coupon *Coupon) Money {
+	_, origin, route := fulfillment(product, defaultOrigin, defaultZone)
+	q := quoteShipping(product, origin, speedTiers[defaultSpeed], zones[defaultZone], handlingFee, now)
+	if q.FreeShipping {
+		return 0
+	}
+	fee := q.Fee.Add(route.Surcharge)
+	if coupon != nil {
+		fee -= coupon.discount(fee)
+	}
+	if _, required := ageVerification(product); required {
+		fee = fee.Add(ageVerificationFee)
+	}
+	fee, _ = capTotalFee(fee.Add(dispatchSurcharge(now)))
+	return fee
+}
+
+const maxBatchSize = 200
+
+// handleBatchShippingFees responds with the fee for each product ID in the JSON array body, in order.
+// Unknown IDs get a null fee and an error instead of failing the whole batch.
+func handleBatchShippingFees(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	if err := decodeJSON(r, &ids); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if len(ids) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("batch size %d exceeds the limit of %d", len(ids), maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	type batchFee struct {
+		ID          int    `json:"id"`
+		ShippingFee *Money `json:"shipping_fee"`
+		Error       string `json:"error,omitempty"`
+	}
+
+	results := make([]batchFee, 0, len(ids))
+	now := localNow()
+	for _, id := range ids {
+		product, err := store.Get(r.Context(), id)
+		if errors.Is(err, errProductNotFound) {
+			productNotFoundTotal.Inc()
+			results = append(results, batchFee{ID: id, Error: "Product not found"})
+			continue
+		}
+		if err != nil {
+			http.Error(w, "Failed to load products", http.StatusInternalServerError)
+			return
+		}
+
+		fee := listedShippingFee(product, now, nil)
+
+		// business metrics
+		feeCalculationsTotal.WithLabelValues("/shipping-fees/batch", product.Category).Inc()
+		feeAmount.WithLabelValues("/shipping-fees/batch", product.Category).Observe(fee.Float())
+		shippingFeeDollars.WithLabelValues(product.Category).Observe(fee.Float())
+
+		results = append(results, batchFee{ID: id, ShippingFee: &fee})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// handleCouponPreview shows how the coupon defined in the JSON body would change each catalog product's
+// listed fee, without saving it. The coupon's expiry is ignored: it is previewed as if it were live.
+func handleCouponPreview(w http.ResponseWriter, r *http.Request) {
+	var coupon Coupon
+	if err := decodeJSON(r, &coupon); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if err := coupon.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	catalog, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	type previewItem struct {
+		ProductID     int    `json:"product_id"`
+		Name          string `json:"name"`
+		CurrentFee    Money  `json:"current_fee"`
+		DiscountedFee Money  `json:"discounted_fee"`
+		Discount      Money  `json:"discount"`
+	}
+	items := make([]previewItem, 0, len(catalog))
+	var totalDiscount Money
+	now := localNow()
+	for _, product := range catalog {
+		current := listedShippingFee(product, now, nil)
+		discounted := listedShippingFee(product, now, &coupon)
+		items = append(items, previewItem{
+			ProductID:     product.ID,
+			Name:          product.Name,
+			CurrentFee:    current,
+			DiscountedFee: discounted,
+			Discount:      current - discounted,
+		})
+		totalDiscount = totalDiscount.Add(current - discounted)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Coupon        Coupon        `json:"coupon"`
+		Items         []previewItem `json:"items"`
+		TotalDiscount Money         `json:"total_discount"`
+	}{coupon, items, totalDiscount})
+}
+
+// feeDetail is one product's entry in the /all-shipping-fees listing.
+type feeDetail struct {
+	ProductID   int     `json:"product_id"`
+	ShippingFee Money   `json:"shipping_fee"`
+	Price       float64 `json:"price"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Category    string  `json:"category"`
+	Weight      float64 `json:"weight"`
+
+	FreeShipping bool `json:"free_shipping"`
+	InStock      bool `json:"in_stock"`
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// parsePagination reads the limit and offset query parameters, clamping limit to maxPageLimit.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit, offset = defaultPageLimit, 0
+
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			return 0, 0, errors.New("limit must be a non-negative integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// productFilter restricts a listing by category and an inclusive price band.
+type productFilter struct {
+	Category    string
+	MinPrice    float64
+	MaxPrice    *float64 // nil means no upper bound
+	InStockOnly bool
+}
+
+// parseProductFilter reads the category, min_price, max_price and in_stock_only query parameters.
+func parseProductFilter(r *http.Request) (productFilter, error) {
+	f := productFilter{Category: r.URL.Query().Get("category")}
+	if raw := r.URL.Query().Get("in_stock_only"); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return productFilter{}, errors.New("in_stock_only must be true or false")
+		}
+		f.InStockOnly = v
+	}
+	var maxPrice float64
+	for name, dst := range map[string]*float64{"min_price": &f.MinPrice, "max_price": &maxPrice} {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v < 0 || math.IsNaN(v) {
+			return productFilter{}, fmt.Errorf("%s must be a non-negative number", name)
+		}
+		*dst = v
+		if name == "max_price" {
+			f.MaxPrice = &maxPrice
+		}
+	}
+	if f.MaxPrice != nil && f.MinPrice > *f.MaxPrice {
+		return productFilter{}, errors.New("min_price must not exceed max_price")
+	}
+	return f, nil
+}
+
+// apply returns the products matching f, comparing prices after conversion at rate.
+func (f productFilter) apply(products []Product, rate float64) []Product {
+	matches := []Product{}
+	for _, p := range products {
+		price := convertPrice(p.Price, rate)
+		switch {
+		case f.Category != "" && p.Category != f.Category:
+		case price < f.MinPrice:
+		case f.MaxPrice != nil && price > *f.MaxPrice:
+		case f.InStockOnly && !p.InStock():
+		default:
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// paginate returns the [offset, offset+limit) window of items.
+func paginate[T any](items []T, limit, offset int) []T {
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
+
+// handleAllShippingFees lists products with their fees as JSON, or as CSV for /all-shipping-fees.csv and ?format=csv.
+func handleAllShippingFees(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currency, rate, err := requestCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseProductFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	catalog, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+	catalog = filter.apply(catalog, rate)
+
+	// a CSV export covers the whole catalog unless a page is asked for explicitly
+	asCSV := strings.HasSuffix(r.URL.Path, ".csv") || r.URL.Query().Get("format") == "csv"
+	if asCSV && !r.URL.Query().Has("limit") {
+		limit = len(catalog)
+	}
+
+	feeDetails := []feeDetail{}
+	now := localNow()
+	for _, product := range paginate(catalog, limit, offset) {
+		fee := listedShippingFee(product, now, nil)
+
+		// business metrics
+		feeCalculationsTotal.WithLabelValues("/all-shipping-fees", product.Category).Inc()
+		feeAmount.WithLabelValues("/all-shipping-fees", product.Category).Observe(fee.Float())
+		shippingFeeDollars.WithLabelValues(product.Category).Observe(fee.Float())
+
+		feeDetails = append(feeDetails, feeDetail{
+			ProductID:   product.ID,
+			ShippingFee: fee.Mul(rate),
+			Price:       convertPrice(product.Price, rate),
+			Name:        product.Name,
+			Description: product.Description,
+			Category:    product.Category,
+			Weight:      product.Weight,
+
+			FreeShipping: qualifiesForFreeShipping(product.Price),
+			InStock:      product.InStock(),
+		})
+	}
+
+	if asCSV {
+		writeFeesCSV(w, feeDetails)
+		return
+	}
+
+	response := struct {
+		Total    int         `json:"total"`
+		Limit    int         `json:"limit"`
+		Offset   int         `json:"offset"`
+		Currency string      `json:"currency"`
+		Items    []feeDetail `json:"items"`
+	}{
+		Total:    len(catalog),
+		Limit:    limit,
+		Offset:   offset,
+		Currency: currency,
+		Items:    feeDetails,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// csvSafe prefixes a text cell that a spreadsheet would evaluate as a formula with
+// a single quote, so product names like "=HYPERLINK(...)" are shown as typed.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// writeFeesCSV writes fees as CSV with a header row of the feeDetail JSON field names.
+func writeFeesCSV(w http.ResponseWriter, fees []feeDetail) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="shipping-fees.csv"`)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"product_id", "shipping_fee", "price", "name", "description", "category", "weight", "free_shipping", "in_stock"})
+	for _, fee := range fees {
+		_ = cw.Write([]string{
+			strconv.Itoa(fee.ProductID),
+			strconv.FormatFloat(fee.ShippingFee.Float(), 'f', -1, 64),
+			strconv.FormatFloat(fee.Price, 'f', -1, 64),
+			csvSafe(fee.Name),
+			csvSafe(fee.Description),
+			csvSafe(fee.Category),
+			strconv.FormatFloat(fee.Weight, 'f', -1, 64),
+			strconv.FormatBool(fee.FreeShipping),
+			strconv.FormatBool(fee.InStock),
+		})
+	}
+	cw.Flush()
+}
+
+// FieldError is one rule of productSchema that a product body broke.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every FieldError found in a product body.
+type ValidationErrors []FieldError
+
+// Error joins the field errors into one message, as reported for rejected import rows.
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// productRule checks one field of a product, returning a message when it is invalid.
+type productRule struct {
+	field string
+	check func(p Product) string
+}
+
+// productSchema declares the constraints on the client-supplied fields of a product.
+var productSchema = []productRule{
+	{"name", stringRule(func(p Product) string { return p.Name }, true, 200)},
+	{"description", stringRule(func(p Product) string { return p.Description }, false, 2000)},
+	{"category", stringRule(func(p Product) string { return p.Category }, true, 100)},
+	{"price", numberRule(func(p Product) float64 { return p.Price }, 0, true, 1_000_000)},
+	{"weight", numberRule(func(p Product) float64 { return p.Weight }, 0, false, 1000)},
+	{"length", numberRule(func(p Product) float64 { return p.Length }, 0, false, 1000)},
+	{"width", numberRule(func(p Product) float64 { return p.Width }, 0, false, 1000)},
+	{"height", numberRule(func(p Product) float64 { return p.Height }, 0, false, 1000)},
+	{"stock_quantity", numberRule(func(p Product) float64 {
+		if p.StockQuantity == nil {
+			return 0
+		}
+		return float64(*p.StockQuantity)
+	}, 0, false, 1_000_000)},
+	{"tags", tagsRule(20, 50)},
+	{"warehouse_id", func(p Product) string {
+		if _, ok := warehouses[p.WarehouseID]; p.WarehouseID != "" && !ok {
+			return "must be a configured warehouse"
+		}
+		return ""
+	}},
+}
+
+// stringRule requires a non-blank value if required, and at most maxLen characters.
+func stringRule(value func(Product) string, required bool, maxLen int) func(Product) string {
+	return func(p Product) string {
+		v := value(p)
+		switch {
+		case required && strings.TrimSpace(v) == "":
+			return "is required"
+		case utf8.RuneCountInString(v) > maxLen:
+			return fmt.Sprintf("must be at most %d characters", maxLen)
+		}
+		return ""
+	}
+}
+
+// numberRule requires a value from min (exclusive if minExclusive) to max.
+func numberRule(value func(Product) float64, min float64, minExclusive bool, max float64) func(Product) string {
+	return func(p Product) string {
+		v := value(p)
+		switch {
+		case minExclusive && v <= min:
+			return fmt.Sprintf("must be greater than %g", min)
+		case v < min:
+			return fmt.Sprintf("must be at least %g", min)
+		case v > max:
+			return fmt.Sprintf("must be at most %g", max)
+		}
+		return ""
+	}
+}
+
+// tagsRule allows at most maxTags non-blank tags of at most maxLen characters each.
+func tagsRule(maxTags, maxLen int) func(Product) string {
+	return func(p Product) string {
+		if len(p.Tags) > maxTags {
+			return fmt.Sprintf("must have at most %d tags", maxTags)
+		}
+		for _, tag := range p.Tags {
+			if strings.TrimSpace(tag) == "" || utf8.RuneCountInString(tag) > maxLen {
+				return fmt.Sprintf("must be non-blank and at most %d characters each", maxLen)
+			}
+		}
+		return ""
+	}
+}
+
+// validateProduct checks the client-supplied fields of a product against productSchema,
+// returning ValidationErrors with every broken rule.
+func validateProduct(p Product) error {
+	var errs ValidationErrors
+	for _, rule := range productSchema {
+		if msg := rule.check(p); msg != "" {
+			errs = append(errs, FieldError{Field: rule.field, Message: msg})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// writeValidationErrors responds 400 with the product validation errors as JSON.
+func writeValidationErrors(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": err})
+}
+
+// -------- Product storage --------
+// errProductNotFound is returned by ProductStore methods for unknown IDs.
+var errProductNotFound = errors.New("product not found")
+
+// ProductStore is the catalog backend the HTTP handlers depend on.
+type ProductStore interface {
+	List(ctx context.Context) ([]Product, error)
+	Get(ctx context.Context, id int) (Product, error)
+	// Create assigns the product a new ID and returns it.
+	Create(ctx context.Context, p Product) (Product, error)
+	// CreateMany assigns IDs to and adds all of ps atomically.
+	CreateMany(ctx context.Context, ps []Product) ([]Product, error)
+	Update(ctx context.Context, p Product) (Product, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// store is the active catalog backend, chosen at startup.
+var store ProductStore = newMemoryStore(seedProducts)
+
+// memoryStore keeps the catalog in a slice, optionally persisted to a JSON file.
+type memoryStore struct {
+	mu       sync.RWMutex // read locks for lookups, write locks for mutations
+	products []Product
+	file     string // empty keeps the catalog in memory only
+}
+
+func newMemoryStore(seed []Product) *memoryStore {
+	return &memoryStore{products: slices.Clone(seed)}
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.products), nil
+}
+
+// Get returns a copy, so no caller is left pointing into the slice after a delete.
+func (s *memoryStore) Get(ctx context.Context, id int) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.products {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Product{}, errProductNotFound
+}
+
+func (s *memoryStore) Create(ctx context.Context, p Product) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := slices.Clone(s.products)
+	p.ID = s.nextID()
+	s.products = append(s.products, p)
+	return p, s.commit(prev)
+}
+
+func (s *memoryStore) CreateMany(ctx context.Context, ps []Product) ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := slices.Clone(s.products)
+	created := make([]Product, 0, len(ps))
+	for _, p := range ps {
+		p.ID = s.nextID()
+		s.products = append(s.products, p)
+		created = append(created, p)
+	}
+	if err := s.commit(prev); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, p Product) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.products, func(existing Product) bool { return existing.ID == p.ID })
+	if i < 0 {
+		return Product{}, errProductNotFound
+	}
+
+	prev := slices.Clone(s.products)
+	s.products[i] = p
+	return p, s.commit(prev)
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.products, func(existing Product) bool { return existing.ID == id })
+	if i < 0 {
+		return errProductNotFound
+	}
+
+	prev := slices.Clone(s.products)
+	s.products = slices.Delete(s.products, i, i+1)
+	return s.commit(prev)
+}
+
+// nextID returns an ID one higher than any in use. Callers must hold s.mu.
+func (s *memoryStore) nextID() int {
+	maxID := 0
+	for _, p := range s.products {
+		if p.ID > maxID {
+			maxID = p.ID
+		}
+	}
+	return maxID + 1
+}
+
+// duplicateIDPolicy decides what load does with products sharing an ID:
+// "fail" rejects the file, "keep-first" and "keep-last" keep one of them.
+var duplicateIDPolicy = "keep-first"
+
+// dedupeProducts applies duplicateIDPolicy to products, logging each collision.
+// A product kept by keep-last takes the place of the first one with its ID.
+func dedupeProducts(products []Product) ([]Product, error) {
+	kept := make([]Product, 0, len(products))
+	index := make(map[int]int, len(products))
+	var errs []error
+	for _, p := range products {
+		i, dup := index[p.ID]
+		if !dup {
+			index[p.ID] = len(kept)
+			kept = append(kept, p)
+			continue
+		}
+		logger.Warn("duplicate product ID", "id", p.ID, "name", p.Name, "kept", kept[i].Name, "policy", duplicateIDPolicy)
+		switch duplicateIDPolicy {
+		case "fail":
+			errs = append(errs, fmt.Errorf("duplicate product ID %d", p.ID))
+		case "keep-last":
+			kept[i] = p
+		}
+	}
+	return kept, errors.Join(errs...)
+}
+
+// load replaces the catalog with the contents of path and persists to it from
+// then on, keeping the current catalog if the file doesn't exist yet.
+// Products with duplicate IDs are resolved by duplicateIDPolicy.
+func (s *memoryStore) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []Product
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if loaded, err = dedupeProducts(loaded); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.products = loaded
+	return nil
+}
+
+// save atomically writes the catalog to s.file via a temp file and rename. Callers must hold s.mu.
+func (s *memoryStore) save() error {
+	data, err := json.MarshalIndent(s.products, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), ".products-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// commit persists the catalog after a mutation, restoring prev if that fails. Callers must hold s.mu.
+func (s *memoryStore) commit(prev []Product) error {
+	if s.file == "" {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		log.Printf("failed to save products to %s: %v", s.file, err)
+		s.products = prev
+		return err
+	}
+	return nil
+}
+
+// productsSchema creates the Postgres products table. Each statement is idempotent;
+// columns added later use ADD COLUMN IF NOT EXISTS so existing databases are migrated in place.
+var productsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS products (
+		id          SERIAL PRIMARY KEY,
+		name        TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		price       DOUBLE PRECISION NOT NULL,
+		category    TEXT NOT NULL,
+		weight      DOUBLE PRECISION NOT NULL DEFAULT 0
+	)`,
+	`ALTER TABLE products
+		ADD COLUMN IF NOT EXISTS length DOUBLE PRECISION NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS width  DOUBLE PRECISION NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS height DOUBLE PRECISION NOT NULL DEFAULT 0`,
+	`ALTER TABLE products ADD COLUMN IF NOT EXISTS oversized BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE products ADD COLUMN IF NOT EXISTS stock_quantity INTEGER`,
+	// NULL is untracked stock, not out of stock
+	`ALTER TABLE products ALTER COLUMN stock_quantity DROP NOT NULL, ALTER COLUMN stock_quantity DROP DEFAULT`,
+	`ALTER TABLE products ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE products ADD COLUMN IF NOT EXISTS warehouse_id TEXT NOT NULL DEFAULT ''`,
+}
+
+const (
+	// productFields are the columns a client can set, in productArgs order.
+	productFields  = "name, description, price, category, weight, length, width, height, oversized, stock_quantity, tags, warehouse_id"
+	productColumns = "id, " + productFields
+
+	insertProductSQL = "INSERT INTO products (" + productFields + ") " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING " + productColumns
+	updateProductSQL = "UPDATE products SET (" + productFields + ") " +
+		"= ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) WHERE id = $13 RETURNING " + productColumns
+)
+
+// productArgs returns p's values for the productFields columns.
+func productArgs(p Product) []any {
+	tags := p.Tags
+	if tags == nil {
+		tags = []string{} // pq sends a nil slice as NULL
+	}
+	return []any{p.Name, p.Description, p.Price, p.Category, p.Weight, p.Length, p.Width, p.Height, p.Oversized, p.StockQuantity, pq.Array(tags), p.WarehouseID}
+}
+
+// postgresStore keeps the catalog in a Postgres products table.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// newPostgresStore connects to dsn, creates the schema if needed and seeds an empty table.
+func newPostgresStore(ctx context.Context, dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &postgresStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies productsSchema and inserts seedProducts into an empty table.
+func (s *postgresStore) migrate(ctx context.Context) error {
+	for _, stmt := range productsSchema {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM products").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range seedProducts {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO products ("+productColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+			append([]any{p.ID}, productArgs(p)...)...,
+		); err != nil {
+			return err
+		}
+	}
+	// keep SERIAL ahead of the explicitly inserted seed IDs
+	if _, err := tx.ExecContext(ctx,
+		"SELECT setval(pg_get_serial_sequence('products', 'id'), (SELECT MAX(id) FROM products))",
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner) (Product, error) {
+	var p Product
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Category, &p.Weight, &p.Length, &p.Width, &p.Height, &p.Oversized, &p.StockQuantity, pq.Array(&p.Tags), &p.WarehouseID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, errProductNotFound
+	}
+	return p, err
+}
+
+func (s *postgresStore) List(ctx context.Context) ([]Product, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+productColumns+" FROM products ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresStore) Get(ctx context.Context, id int) (Product, error) {
+	return scanProduct(s.db.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = $1", id))
+}
+
+func (s *postgresStore) Create(ctx context.Context, p Product) (Product, error) {
+	return scanProduct(s.db.QueryRowContext(ctx, insertProductSQL, productArgs(p)...))
+}
+
+func (s *postgresStore) CreateMany(ctx context.Context, ps []Product) ([]Product, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created := make([]Product, 0, len(ps))
+	for _, p := range ps {
+		p, err := scanProduct(tx.QueryRowContext(ctx, insertProductSQL, productArgs(p)...))
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, p)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *postgresStore) Update(ctx context.Context, p Product) (Product, error) {
+	return scanProduct(s.db.QueryRowContext(ctx, updateProductSQL, append(productArgs(p), p.ID)...))
+}
+
+func (s *postgresStore) Delete(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM products WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProductNotFound
+	}
+	return nil
+}
+
+// handleCreateProduct adds a product from the JSON body to the catalog and responds with it, including its new ID.
+func handleCreateProduct(w http.ResponseWriter, r *http.Request) {
+	var product Product
+	if err := decodeJSON(r, &product); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if err := validateProduct(product); err != nil {
+		writeValidationErrors(w, err)
+		return
+	}
+
+	product, err := store.Create(r.Context(), product)
+	if err != nil {
+		http.Error(w, "Failed to save product", http.StatusInternalServerError)
+		return
+	}
+	productsTotal.Inc()
+	feesCache.purge()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(product)
+}
+
+// handleSearchProducts lists products whose name or description contains q, ignoring case,
+// optionally restricted by category and price band.
+func handleSearchProducts(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseProductFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	catalog, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	matches := []Product{}
+	for _, product := range filter.apply(catalog, 1) {
+		if strings.Contains(strings.ToLower(product.Name), query) || strings.Contains(strings.ToLower(product.Description), query) {
+			matches = append(matches, product)
+		}
+	}
+
+	response := struct {
+		Total  int       `json:"total"`
+		Limit  int       `json:"limit"`
+		Offset int       `json:"offset"`
+		Items  []Product `json:"items"`
+	}{
+		Total:  len(matches),
+		Limit:  limit,
+		Offset: offset,
+		Items:  paginate(matches, limit, offset),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// missingShippingData lists what p lacks for an accurate fee.
+func missingShippingData(p Product) []string {
+	var missing []string
+	if p.Weight <= 0 {
+		missing = append(missing, "weight is missing")
+	}
+	if p.Length <= 0 || p.Width <= 0 || p.Height <= 0 {
+		missing = append(missing, "dimensions are missing")
+	}
+	return missing
+}
+
+// handleIncompleteProducts lists products whose fees are inaccurate for lack of weight or dimensions.
+func handleIncompleteProducts(w http.ResponseWriter, r *http.Request) {
+	catalog, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	type incomplete struct {
+		Product
+		Reasons []string `json:"reasons"`
+	}
+	results := []incomplete{}
+	for _, product := range catalog {
+		if reasons := missingShippingData(product); len(reasons) > 0 {
+			results = append(results, incomplete{Product: product, Reasons: reasons})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+const maxImportSize = 1000
+
+// handleImportProducts adds every valid product in the JSON array body in one store operation,
+// reporting the rejected rows by index instead of failing the whole import.
+func handleImportProducts(w http.ResponseWriter, r *http.Request) {
+	var rows []json.RawMessage
+	if err := decodeJSON(r, &rows); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if len(rows) > maxImportSize {
+		http.Error(w, fmt.Sprintf("import size %d exceeds the limit of %d", len(rows), maxImportSize), http.StatusBadRequest)
+		return
+	}
+
+	type rejectedRow struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	}
+	valid := []Product{}
+	rejected := []rejectedRow{}
+	for i, row := range rows {
+		var product Product
+		dec := json.NewDecoder(bytes.NewReader(row))
+		if disallowUnknownFields {
+			dec.DisallowUnknownFields()
+		}
+		err := dec.Decode(&product)
+		if err == nil {
+			err = validateProduct(product)
+		}
+		if err != nil {
+			rejected = append(rejected, rejectedRow{Index: i, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, product)
+	}
+
+	imported, err := store.CreateMany(r.Context(), valid)
+	if err != nil {
+		http.Error(w, "Failed to save products", http.StatusInternalServerError)
+		return
+	}
+	productsTotal.Add(float64(len(imported)))
+	feesCache.purge()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Imported int           `json:"imported"`
+		Products []Product     `json:"products"`
+		Rejected []rejectedRow `json:"rejected"`
+	}{len(imported), imported, rejected})
+}
+
+// handleProduct serves a single product addressed by /products/{id}.
+func handleProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		handleGetProduct(w, r, id)
+	case http.MethodPut:
+		handleUpdateProduct(w, r, id)
+	case http.MethodDelete:
+		handleDeleteProduct(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, OPTIONS")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGetProduct responds with product id, without computing a shipping fee.
+func handleGetProduct(w http.ResponseWriter, r *http.Request, id int) {
+	product, err := store.Get(r.Context(), id)
+	if errors.Is(err, errProductNotFound) {
+		productNotFoundTotal.Inc()
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load product", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(product)
+}
+
+// handleUpdateProduct replaces the mutable fields of product id with the JSON body and responds with the result.
+func handleUpdateProduct(w http.ResponseWriter, r *http.Request, id int) {
+	var update Product
+	if err := decodeJSON(r, &update); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if err := validateProduct(update); err != nil {
+		writeValidationErrors(w, err)
+		return
+	}
+	update.ID = id
+
+	update, err := store.Update(r.Context(), update)
+	if errors.Is(err, errProductNotFound) {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save product", http.StatusInternalServerError)
+		return
+	}
+	feesCache.purge()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(update)
+}
+
+// handleDeleteProduct removes product id from the catalog.
+func handleDeleteProduct(w http.ResponseWriter, r *http.Request, id int) {
+	err := store.Delete(r.Context(), id)
+	if errors.Is(err, errProductNotFound) {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete product", http.StatusInternalServerError)
+		return
+	}
+	productsTotal.Dec()
+	feesCache.purge()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// -------- Health probe access --------
+// healthAllowedNets restricts health endpoints to these networks; empty means open.
+var healthAllowedNets []*net.IPNet
+
+// trustedProxies are the networks of reverse proxies whose X-Forwarded-For headers are believed.
+var trustedProxies []*net.IPNet
+
+// parseCIDRList parses a comma-separated list of CIDR ranges.
+func parseCIDRList(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// inNets reports whether ip is inside any of nets.
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the originating client IP. X-Forwarded-For is only honoured when the direct peer
+// is one of trustedProxies, and then the client is the right-most hop that isn't a trusted proxy itself,
+// since anything further left was written by the client and can be spoofed.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !inNets(ip, trustedProxies) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNets(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// healthGuard rejects health probes from outside healthAllowedNets with 403.
+func healthGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(healthAllowedNets) == 0 {
+			next(w, r)
+			return
+		}
+
+		if inNets(clientIP(r), healthAllowedNets) {
+			next(w, r)
+			return
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
+
+// probe wraps a health check served outside the standard middleware chain, so probes are
+// never rate limited or timed out; like every route, it answers other methods with 405.
+func probe(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return instrument(pattern, allowMethods("GET, HEAD", healthGuard(h)))
+}
+
+// Build info, set with e.g. -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// handleVersion reports which build is running.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	})
+}
+
+// metricsAuthToken, when set, must be presented to scrape /metrics, either as a bearer
+// token or as a basic-auth password; empty leaves /metrics open.
+var metricsAuthToken string
+
+// metricsGuard rejects scrapes without metricsAuthToken with 401.
+func metricsGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if metricsAuthToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, presented, _ = r.BasicAuth()
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(metricsAuthToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ready is set once startup has finished and cleared when shutdown begins.
+var ready atomic.Bool
+
+// handleReadyz reports whether the server should receive traffic.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"not ready"}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ready"}`))
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// -------- Configuration --------
+// envConfig reads settings from the environment, collecting every problem
+// instead of stopping at the first one.
+type envConfig struct {
+	errs []error
+}
+
+func (c *envConfig) errorf(format string, args ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// money parses a non-negative dollar amount.
+func (c *envConfig) money(name string, dst *Money) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 {
+		c.errorf("%s: %q is not a non-negative amount", name, raw)
+		return
+	}
+	*dst = MoneyFromFloat(f)
+}
+
+// float parses a non-negative number.
+func (c *envConfig) float(name string, dst *float64) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 {
+		c.errorf("%s: %q is not a non-negative number", name, raw)
+		return
+	}
+	*dst = f
+}
+
+// integer parses an integer within [min, max].
+func (c *envConfig) integer(name string, dst *int, min, max int) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min || n > max {
+		c.errorf("%s: %q is not an integer between %d and %d", name, raw, min, max)
+		return
+	}
+	*dst = n
+}
+
+// duration parses a positive Go duration such as "10s".
+func (c *envConfig) duration(name string, dst *time.Duration) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		c.errorf("%s: %q is not a positive duration", name, raw)
+		return
+	}
+	*dst = d
+}
+
+// timeOfDay parses an "HH:MM" time, or a bare hour, into minutes after midnight.
+func (c *envConfig) timeOfDay(name string, dst *int) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	minute, err := parseTimeOfDay(raw)
+	if err != nil {
+		c.errorf("%s: %v", name, err)
+		return
+	}
+	*dst = minute
+}
+
+func (c *envConfig) boolean(name string, dst *bool) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		c.errorf("%s: %q is not a boolean", name, raw)
+		return
+	}
+	*dst = b
+}
+
+// set parses a comma-separated list into a set, replacing the default.
+func (c *envConfig) set(name string, dst *map[string]bool) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return
+	}
+	items := map[string]bool{}
+	for _, item := range splitList(raw) {
+		items[item] = true
+	}
+	*dst = items
+}
+
+// isKnownCategory reports whether category has a multiplier or appears in the catalog.
+func isKnownCategory(category string) bool {
+	if _, ok := categoryMultipliers[category]; ok {
+		return true
+	}
+	catalog, err := store.List(context.Background())
+	if err != nil {
+		return false
+	}
+	for _, product := range catalog {
+		if product.Category == category {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAddr is the host:port the server binds to.
+var listenAddr = ":8080"
+
+// parseListenAddr validates a host:port listen address.
+func parseListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// tlsCertFile and tlsKeyFile switch the server to HTTPS (with HTTP/2) when both are set.
+var tlsCertFile, tlsKeyFile string
+
+// shutdownTimeout bounds how long in-flight requests get to finish on SIGINT/SIGTERM.
+var shutdownTimeout = 10 * time.Second
+
+// readinessDrain is how long /readyz reports not ready before shutdown starts,
+// giving load balancers time to stop routing new requests here.
+var readinessDrain = 5 * time.Second
+
+// Server connection timeouts, so slow or stalled clients can't hold connections open.
+var (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 15 * time.Second
+	idleTimeout       = 60 * time.Second
+)
+
+// loadConfig reads all settings from the environment and validates them,
+// returning every problem found so a deployment can be fixed in one pass.
+func loadConfig() error {
+	c := &envConfig{}
+
+	if raw := os.Getenv("PORT"); raw != "" {
+		listenAddr = ":" + raw
+	}
+	if raw := os.Getenv("LISTEN_ADDR"); raw != "" {
+		listenAddr = raw
+	}
+	if err := parseListenAddr(listenAddr); err != nil {
+		c.errorf("LISTEN_ADDR/PORT: %q: %v", listenAddr, err)
+	}
+	tlsCertFile, tlsKeyFile = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	switch {
+	case (tlsCertFile == "") != (tlsKeyFile == ""):
+		c.errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case tlsCertFile != "":
+		if _, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile); err != nil {
+			c.errorf("TLS_CERT_FILE/TLS_KEY_FILE: %v", err)
+		}
+	}
+	c.duration("SHUTDOWN_TIMEOUT", &shutdownTimeout)
+	c.duration("READINESS_DRAIN", &readinessDrain)
+	c.duration("READ_HEADER_TIMEOUT", &readHeaderTimeout)
+	c.duration("READ_TIMEOUT", &readTimeout)
+	c.duration("WRITE_TIMEOUT", &writeTimeout)
+	c.duration("IDLE_TIMEOUT", &idleTimeout)
+	c.duration("REQUEST_TIMEOUT", &requestTimeout)
+	c.duration("FEES_CACHE_TTL", &feesCacheTTL)
+	c.duration("IDEMPOTENCY_TTL", &idempotencyTTL)
+	c.integer("GZIP_MIN_SIZE", &gzipMinSize, 0, math.MaxInt32)
+	allowedOrigins = splitList(os.Getenv("ALLOWED_ORIGINS"))
+
+	if raw := os.Getenv("DUPLICATE_ID_POLICY"); raw != "" {
+		if raw != "fail" && raw != "keep-first" && raw != "keep-last" {
+			c.errorf("DUPLICATE_ID_POLICY: %q is not fail, keep-first or keep-last", raw)
+		}
+		duplicateIDPolicy = raw
+	}
+
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		pg, err := newPostgresStore(ctx, dsn)
+		cancel()
+		if err != nil {
+			c.errorf("DATABASE_URL: %v", err)
+		} else {
+			store = pg
+		}
+	} else if path := os.Getenv("PRODUCTS_FILE"); path != "" {
+		mem := newMemoryStore(seedProducts)
+		if err := mem.load(path); err != nil {
+			c.errorf("PRODUCTS_FILE: %v", err)
+		}
+		store = mem
+	}
+
+	if raw := os.Getenv("SHIPPING_SPEEDS"); raw != "" {
+		var table map[string]SpeedTier
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("SHIPPING_SPEEDS: %v", err)
+		} else {
+			speedTiers = table
+		}
+	}
+	if raw := os.Getenv("WAREHOUSES"); raw != "" {
+		var table map[string]Warehouse
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("WAREHOUSES: %v", err)
+		} else {
+			warehouses = table
+		}
+	}
+	if raw := os.Getenv("SHIPPING_ZONES"); raw != "" {
+		var table map[string]Zone
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("SHIPPING_ZONES: %v", err)
+		} else {
+			zones = table
+		}
+	}
+	if raw := os.Getenv("WAREHOUSE_ROUTES"); raw != "" {
+		var table map[string]map[string]Route
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("WAREHOUSE_ROUTES: %v", err)
+		} else {
+			routes = table
+		}
+	}
+
+	// CATEGORY_MULTIPLIERS_FILE names a file holding the same JSON object as CATEGORY_MULTIPLIERS.
+	raw, source := os.Getenv("CATEGORY_MULTIPLIERS"), "CATEGORY_MULTIPLIERS"
+	if path := os.Getenv("CATEGORY_MULTIPLIERS_FILE"); path != "" && raw == "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			c.errorf("CATEGORY_MULTIPLIERS_FILE: %v", err)
+		}
+		raw, source = string(data), "CATEGORY_MULTIPLIERS_FILE"
+	}
+	if raw != "" {
+		var table map[string]float64
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("%s: %v", source, err)
+		} else {
+			categoryMultipliers = table
+		}
+	}
+
+	c.float("DEFAULT_CATEGORY_MULTIPLIER", &defaultCategoryMultiplier)
+
+	if raw := os.Getenv("CATEGORY_FEE_LIMITS"); raw != "" {
+		var table map[string]FeeLimits
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("CATEGORY_FEE_LIMITS: %v", err)
+		} else {
+			categoryFeeLimits = table
+		}
+	}
+	if raw := os.Getenv("TAG_SURCHARGES"); raw != "" {
+		var table map[string]Money
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("TAG_SURCHARGES: %v", err)
+		} else {
+			tagSurcharges = make(map[string]Money, len(table))
+			for tag, surcharge := range table {
+				tagSurcharges[strings.ToLower(tag)] = surcharge
+			}
+		}
+	}
+	if raw := os.Getenv("CATEGORY_RISK_SURCHARGES"); raw != "" {
+		var table map[string]Money
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("CATEGORY_RISK_SURCHARGES: %v", err)
+		} else {
+			categoryRiskSurcharges = table
+		}
+	}
+
+	if raw := os.Getenv("COUPONS"); raw != "" {
+		var table map[string]Coupon
+		if err := json.Unmarshal([]byte(raw), &table); err != nil {
+			c.errorf("COUPONS: %v", err)
+		}
+		for code, coupon := range table {
+			coupons[strings.ToUpper(code)] = coupon
+		}
+	}
+
+	if raw := os.Getenv("HEALTH_ALLOWED_CIDRS"); raw != "" {
+		nets, err := parseCIDRList(raw)
+		if err != nil {
+			c.errorf("HEALTH_ALLOWED_CIDRS: %v", err)
+		}
+		healthAllowedNets = nets
+	}
+	if raw := os.Getenv("TRUSTED_PROXY_CIDRS"); raw != "" {
+		nets, err := parseCIDRList(raw)
+		if err != nil {
+			c.errorf("TRUSTED_PROXY_CIDRS: %v", err)
+		}
+		trustedProxies = nets
+	}
+	metricsAuthToken = os.Getenv("METRICS_AUTH_TOKEN")
+
+	c.money("BASE_FEE", &baseFee)
+	c.money("PER_KG_RATE", &perKgRate)
+	c.float("VOLUMETRIC_DIVISOR", &volumetricDivisor)
+	c.money("OVERSIZED_SURCHARGE", &oversizedSurcharge)
+	c.float("OVERSIZED_SIDE_CM", &oversizedSide)
+	c.float("FREE_SHIPPING_THRESHOLD", &freeShippingThreshold)
+	for _, entry := range splitList(os.Getenv("CURRENCY_RATES")) {
+		code, raw, _ := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || rate <= 0 {
+			c.errorf("CURRENCY_RATES: %q is not CODE=positive rate", entry)
+			continue
+		}
+		currencyRates[strings.ToUpper(strings.TrimSpace(code))] = rate
+	}
+	c.timeOfDay("PEAK_HOURS_START", &peakHours.Start)
+	c.timeOfDay("PEAK_HOURS_END", &peakHours.End)
+	c.money("PEAK_SURCHARGE", &peakHours.Surcharge)
+	c.money("WEEKEND_SURCHARGE", &weekendSurcharge)
+	c.money("MAX_TOTAL_FEE", &maxTotalFee)
+	if raw := os.Getenv("SEASONAL_SURCHARGES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &seasons); err != nil {
+			c.errorf("SEASONAL_SURCHARGES: %v", err)
+		}
+	}
+	shippingLocation = loadShippingLocation()
+
+	c.set("DEBUG_BODY_ROUTES", &bodyLogRoutes)
+	c.integer("DEBUG_BODY_MAX_BYTES", &bodyLogMaxSize, 1, math.MaxInt32)
+	c.integer("MAX_BODY_BYTES", &maxBodyBytes, 1, math.MaxInt32)
+	c.boolean("JSON_DISALLOW_UNKNOWN_FIELDS", &disallowUnknownFields)
+	c.boolean("DEDUP_ENABLED", &dedupEnabled)
+	c.boolean("FEE_TRACE_LOGGING", &feeTraceLogging)
+
+	c.boolean("CHAOS_ENABLED", &chaosEnabled)
+	var latencyMS int
+	c.integer("CHAOS_LATENCY_MS", &latencyMS, 0, 60_000)
+	chaosLatency = time.Duration(latencyMS) * time.Millisecond
+	c.float("CHAOS_ERROR_RATE", &chaosErrorRate)
+	switch {
+	case chaosEnabled:
+		log.Printf("WARNING: chaos testing enabled: %v latency and %g%% errors injected into every route",
+			chaosLatency, chaosErrorRate*100)
+	case chaosLatency > 0 || chaosErrorRate > 0:
+		c.errorf("CHAOS_LATENCY_MS/CHAOS_ERROR_RATE: set CHAOS_ENABLED=true to inject chaos")
+	}
+	c.float("RATE_LIMIT_RPS", &rateLimitRPS)
+	c.integer("RATE_LIMIT_BURST", &rateLimitBurst, 1, math.MaxInt32)
+	if jwtSecret = []byte(os.Getenv("JWT_SECRET")); len(jwtSecret) == 0 {
+		log.Printf("JWT_SECRET not set; product writes will be rejected")
+	}
+
+	c.set("AGE_VERIFICATION_CATEGORIES", &ageVerificationCategories)
+	c.set("AGE_VERIFICATION_TAGS", &ageVerificationTags)
+	ageTags := make(map[string]bool, len(ageVerificationTags))
+	for tag := range ageVerificationTags {
+		ageTags[strings.ToLower(tag)] = true
+	}
+	ageVerificationTags = ageTags
+	c.money("AGE_VERIFICATION_FEE", &ageVerificationFee)
+	c.set("AGE_VERIFICATION_ZONES", &ageVerificationZones)
+	c.set("AGE_VERIFICATION_SPEEDS", &ageVerificationSpeeds)
+
+	c.money("OFF_HOURS_DISPATCH_SURCHARGE", &offHoursDispatchSurcharge)
+	c.integer("BUSINESS_HOURS_START", &businessHoursStart, 0, 23)
+	c.integer("BUSINESS_HOURS_END", &businessHoursEnd, 0, 24)
+
+	if raw := os.Getenv("COD_FEE_TYPE"); raw != "" {
+		if raw != "flat" && raw != "percent" {
+			c.errorf("COD_FEE_TYPE: %q is not flat or percent", raw)
+		}
+		codFeeType = raw
+	}
+	c.float("COD_FEE", &codFee)
+	c.set("COD_ZONES", &codZones)
+
+	c.money("HANDLING_FEE", &handlingFee)
+	if raw := os.Getenv("HANDLING_FEE_TYPE"); raw != "" {
+		if raw != "flat" && raw != "per_item" {
+			c.errorf("HANDLING_FEE_TYPE: %q is not flat or per_item", raw)
+		}
+		handlingFeeType = raw
+	}
+
+	if raw := os.Getenv("ROUNDING_MODE"); raw != "" {
+		if _, ok := roundingModes[raw]; !ok {
+			c.errorf("ROUNDING_MODE: %q is not half_up, bankers or ceil", raw)
+		} else {
+			roundingMode = raw
+		}
+	}
+
+	c.float("INSURANCE_PERCENT", &insurancePercent)
+	c.money("SIGNATURE_FEE", &signatureFee)
+	c.set("HIGH_THEFT_ZONES", &highTheftZones)
+	c.money("BUNDLE_DISCOUNT_PER_ITEM", &bundleDiscountPerItem)
+	c.integer("PACKAGE_MAX_ITEMS", &packageMaxItems, 0, math.MaxInt32)
+	c.float("PACKAGE_MAX_WEIGHT", &packageMaxWeight)
+	if raw := os.Getenv("ESTIMATE_MISSING_PRICE"); raw != "" {
+		if raw != "skip" && raw != "require" && raw != "assume" {
+			c.errorf("ESTIMATE_MISSING_PRICE: %q is not skip, require or assume", raw)
+		}
+		estimateMissingPrice = raw
+	}
+	c.float("ESTIMATE_ASSUMED_PRICE", &estimateAssumedPrice)
+	if raw := os.Getenv("CART_PRICING"); raw != "" {
+		if raw != "sum" && raw != "dominant" {
+			c.errorf("CART_PRICING: %q is not sum or dominant", raw)
+		}
+		cartPricing = raw
+	}
+
+	c.money("APPOINTMENT_FEE", &appointmentFee)
+	c.set("APPOINTMENT_CATEGORIES", &appointmentCategories)
+	c.set("APPOINTMENT_ZONES", &appointmentZones)
+	if raw := os.Getenv("APPOINTMENT_WINDOWS"); raw != "" {
+		appointmentWindows = splitList(raw)
+	}
+
+	return errors.Join(append(c.errs, validateConfig()...)...)
+}
+
+// validateConfig checks the loaded settings for inconsistencies between values.
+func validateConfig() []error {
+	var errs []error
+
+	if chaosErrorRate > 1 {
+		errs = append(errs, fmt.Errorf("CHAOS_ERROR_RATE: %g is not a fraction from 0 to 1", chaosErrorRate))
+	}
+	if businessHoursStart >= businessHoursEnd {
+		errs = append(errs, fmt.Errorf("business hours %d-%d: start must be before end", businessHoursStart, businessHoursEnd))
+	}
+	if peakHours.Start > peakHours.End {
+		errs = append(errs, fmt.Errorf("peak hours %s-%s: start is after end", formatTimeOfDay(peakHours.Start), formatTimeOfDay(peakHours.End)))
+	}
+
+	if writeTimeout <= requestTimeout {
+		errs = append(errs, fmt.Errorf("WRITE_TIMEOUT %v must exceed REQUEST_TIMEOUT %v so timed-out requests still get their 503", writeTimeout, requestTimeout))
+	}
+	if volumetricDivisor <= 0 {
+		errs = append(errs, errors.New("VOLUMETRIC_DIVISOR must be positive"))
+	}
+	if baseFee < 0 {
+		errs = append(errs, errors.New("base fee must not be negative"))
+	}
+	for category, m := range categoryMultipliers {
+		if m <= 0 {
+			errs = append(errs, fmt.Errorf("multiplier for %q must be positive", category))
+		}
+	}
+	for _, season := range seasons {
+		start, startErr := time.Parse(time.DateOnly, season.Start)
+		end, endErr := time.Parse(time.DateOnly, season.End)
+		switch {
+		case startErr != nil || endErr != nil:
+			errs = append(errs, fmt.Errorf("SEASONAL_SURCHARGES: %q: start and end must be YYYY-MM-DD dates", season.Name))
+		case end.Before(start):
+			errs = append(errs, fmt.Errorf("SEASONAL_SURCHARGES: %q: end is before start", season.Name))
+		case season.Surcharge < 0:
+			errs = append(errs, fmt.Errorf("SEASONAL_SURCHARGES: %q: surcharge must not be negative", season.Name))
+		}
+	}
+	for code, coupon := range coupons {
+		if err := coupon.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("COUPONS: %q: %w", code, err))
+		}
+	}
+	if defaultCategoryMultiplier <= 0 {
+		errs = append(errs, errors.New("DEFAULT_CATEGORY_MULTIPLIER must be positive"))
+	}
+	for tag, surcharge := range tagSurcharges {
+		if surcharge < 0 {
+			errs = append(errs, fmt.Errorf("TAG_SURCHARGES: surcharge for %q must not be negative", tag))
+		}
+	}
+	for category, surcharge := range categoryRiskSurcharges {
+		if surcharge < 0 {
+			errs = append(errs, fmt.Errorf("CATEGORY_RISK_SURCHARGES: surcharge for %q must not be negative", category))
+		}
+	}
+	for category, limits := range categoryFeeLimits {
+		if limits.MinFee < 0 || limits.MaxFee < 0 {
+			errs = append(errs, fmt.Errorf("CATEGORY_FEE_LIMITS: limits for %q must not be negative", category))
+		}
+		if limits.MaxFee > 0 && limits.MinFee > limits.MaxFee {
+			errs = append(errs, fmt.Errorf("CATEGORY_FEE_LIMITS: min_fee for %q is above its max_fee", category))
+		}
+	}
+	if _, ok := warehouses[defaultOrigin]; !ok {
+		errs = append(errs, fmt.Errorf("WAREHOUSES: default origin %q is missing", defaultOrigin))
+	}
+	for name, warehouse := range warehouses {
+		if warehouse.Multiplier <= 0 || warehouse.DispatchDays < 0 {
+			errs = append(errs, fmt.Errorf("WAREHOUSES: origin %q needs a positive multiplier and non-negative dispatch days", name))
+		}
+	}
+	if _, ok := zones[defaultZone]; !ok {
+		errs = append(errs, fmt.Errorf("SHIPPING_ZONES: default zone %q is missing", defaultZone))
+	}
+	for name, zone := range zones {
+		if zone.Multiplier <= 0 || zone.Surcharge < 0 || zone.ExtraDays < 0 {
+			errs = append(errs, fmt.Errorf("SHIPPING_ZONES: zone %q needs a positive multiplier, a non-negative surcharge and non-negative extra days", name))
+		}
+	}
+	for name, toZones := range routes {
+		if _, ok := warehouses[name]; !ok {
+			errs = append(errs, fmt.Errorf("WAREHOUSE_ROUTES: unknown warehouse %q", name))
+		}
+		for zone, route := range toZones {
+			if _, ok := zones[zone]; !ok {
+				errs = append(errs, fmt.Errorf("WAREHOUSE_ROUTES: unknown zone %q", zone))
+			}
+			if route.Surcharge < 0 || route.ExtraDays < 0 {
+				errs = append(errs, fmt.Errorf("WAREHOUSE_ROUTES: route from %q to %q needs a non-negative surcharge and extra days", name, zone))
+			}
+		}
+	}
+	if _, ok := speedTiers[defaultSpeed]; !ok {
+		errs = append(errs, fmt.Errorf("SHIPPING_SPEEDS: default speed %q is missing", defaultSpeed))
+	}
+	for name, tier := range speedTiers {
+		if tier.Multiplier <= 0 || tier.DeliveryDays < 0 {
+			errs = append(errs, fmt.Errorf("SHIPPING_SPEEDS: speed %q needs a positive multiplier and non-negative delivery days", name))
+		}
+		if tier.MinDeliveryDays < 0 || tier.MinDeliveryDays > tier.DeliveryDays {
+			errs = append(errs, fmt.Errorf("SHIPPING_SPEEDS: speed %q has min_delivery_days outside 0..delivery_days", name))
+		}
+	}
+	if codFeeType == "percent" && codFee > 100 {
+		errs = append(errs, fmt.Errorf("COD_FEE: %g%% exceeds 100%%", codFee))
+	}
+	for name, eligible := range map[string]map[string]bool{
+		"COD_ZONES":              codZones,
+		"APPOINTMENT_ZONES":      appointmentZones,
+		"HIGH_THEFT_ZONES":       highTheftZones,
+		"AGE_VERIFICATION_ZONES": ageVerificationZones,
+	} {
+		for zone := range eligible {
+			if _, ok := zones[zone]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown zone %q", name, zone))
+			}
+		}
+	}
+	for speed := range ageVerificationSpeeds {
+		if _, ok := speedTiers[speed]; !ok {
+			errs = append(errs, fmt.Errorf("AGE_VERIFICATION_SPEEDS: unknown speed %q", speed))
+		}
+	}
+
+	for name, categories := range map[string]map[string]bool{
+		"AGE_VERIFICATION_CATEGORIES": ageVerificationCategories,
+		"APPOINTMENT_CATEGORIES":      appointmentCategories,
+	} {
+		for category := range categories {
+			if !isKnownCategory(category) {
+				errs = append(errs, fmt.Errorf("%s: unknown category %q", name, category))
+			}
+		}
+	}
+
+	return errs
+}
+
+func main() {
+	if err := loadConfig(); err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	// the catalog may have come from PRODUCTS_FILE or the database rather than the seed
+	if catalog, err := store.List(context.Background()); err == nil {
+		productsTotal.Set(float64(len(catalog)))
+	}
+
+	// Routes (logged + CORS + instrumented)
+	handle("/shipping-fee", "GET, OPTIONS", dedupe(handleShippingFee))
+	handle("/estimate", "POST, OPTIONS", handleEstimate)
+	handle("/shipping-explanation", "GET, OPTIONS", handleShippingExplanation)
+	handle("/categories", "GET, OPTIONS", handleCategories)
+	handle("/all-shipping-fees", "GET, OPTIONS", withETag(cacheResponses(feesCache, handleAllShippingFees)))
+	handle("/all-shipping-fees.csv", "GET, OPTIONS", withETag(cacheResponses(feesCache, handleAllShippingFees)))
+	handle("/shipping-fees/batch", "POST, OPTIONS", handleBatchShippingFees)
+	handle("/admin/coupon-preview", "POST, OPTIONS", requireAuth(handleCouponPreview))
+	handle("/products", "POST, OPTIONS", requireAuth(idempotent(handleCreateProduct)))
+	handle("/products/search", "GET, OPTIONS", handleSearchProducts)
+	handle("/products/incomplete", "GET, OPTIONS", handleIncompleteProducts)
+	handle("/products/import", "POST, OPTIONS", requireAuth(handleImportProducts))
+	handle("/products/{id}", "GET, PUT, DELETE, OPTIONS", requireAuth(withETag(handleProduct)))
+	handle("/products/{id}/shipping-fee", "GET, OPTIONS", dedupe(handleProductShippingFee))
+
+	// Health, build info + Metrics
+	http.HandleFunc("/healthz", probe("/healthz", handleHealthz))
+	http.HandleFunc("/readyz", probe("/readyz", handleReadyz))
+	handle("/version", "GET, OPTIONS", handleVersion)
+	http.Handle("/metrics", metricsGuard(allowMethods("GET, HEAD", promhttp.Handler().ServeHTTP)))
+
+	server := &http.Server{
+		Addr:              listenAddr,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	log.Printf("server timeouts: read header %v, read %v, write %v, idle %v",
+		readHeaderTimeout, readTimeout, writeTimeout, idleTimeout)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Bind before reporting ready so /readyz never claims a port we failed to get.
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		var err error
+		if tlsCertFile != "" {
+			log.Printf("serving HTTPS (HTTP/2 enabled) with certificate %s", tlsCertFile)
+			fmt.Printf("Server is running on %s (TLS)...\n", ln.Addr())
+			err = server.ServeTLS(ln, tlsCertFile, tlsKeyFile)
+		} else {
+			log.Printf("serving plain HTTP; set TLS_CERT_FILE and TLS_KEY_FILE for HTTPS")
+			fmt.Printf("Server is running on %s...\n", ln.Addr())
+			err = server.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	ready.Store(true)
+
+	<-ctx.Done()
+	stop()
+	ready.Store(false)
+	log.Printf("Draining for %s before shutdown...", readinessDrain)
+	time.Sleep(readinessDrain)
+
+	// Let in-flight requests finish before exiting.
+	log.Printf("Shutting down server (timeout %s)...", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown did not complete: %v", err)
+		return
+	}
+	log.Println("Server stopped")
 }
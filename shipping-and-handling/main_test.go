@@ -0,0 +1,1944 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fixedClock is a Clock stopped at one instant.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// setClock stops the clock at now, in UTC, for the rest of the test.
+func setClock(t testing.TB, now time.Time) {
+	t.Helper()
+	prevClock, prevLocation := clock, shippingLocation
+	clock, shippingLocation = fixedClock(now), time.UTC
+	t.Cleanup(func() { clock, shippingLocation = prevClock, prevLocation })
+}
+
+// wednesdayAt returns hour:minute:second on a weekday outside any season, in UTC.
+func wednesdayAt(hour, minute, second int) time.Time {
+	return time.Date(2026, time.March, 4, hour, minute, second, 0, time.UTC)
+}
+
+// allShippingFees calls handleAllShippingFees for the whole seed catalog and returns the fee per product ID.
+func allShippingFees(t testing.TB) map[int]Money {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleAllShippingFees(rec, httptest.NewRequest(http.MethodGet, "/all-shipping-fees?limit=100", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /all-shipping-fees: status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Items []feeDetail `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding /all-shipping-fees: %v", err)
+	}
+	fees := make(map[int]Money, len(body.Items))
+	for _, item := range body.Items {
+		fees[item.ProductID] = item.ShippingFee
+	}
+	return fees
+}
+
+func BenchmarkQuoteShipping(b *testing.B) {
+	now := wednesdayAt(15, 0, 0)
+	product := seedProducts[0]
+	origin, speed, zone := warehouses[defaultOrigin], speedTiers[defaultSpeed], zones[defaultZone]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		quoteShipping(product, origin, speed, zone, handlingFee, now)
+	}
+}
+
+func BenchmarkAllShippingFees(b *testing.B) {
+	setClock(b, wednesdayAt(15, 0, 0))
+	req := httptest.NewRequest(http.MethodGet, "/all-shipping-fees?limit=100", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handleAllShippingFees(httptest.NewRecorder(), req)
+	}
+}
+
+// TestAllShippingFeesPeakBoundary checks that every listed fee picks up the peak surcharge
+// exactly from the first second of peak hours and drops it exactly at their end.
+func TestAllShippingFeesPeakBoundary(t *testing.T) {
+	setClock(t, wednesdayAt(12, 0, 0))
+	offPeak := allShippingFees(t)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		peak bool
+	}{
+		{"last second before peak", wednesdayAt(13, 59, 59), false},
+		{"start of peak", wednesdayAt(14, 0, 0), true},
+		{"last second of peak", wednesdayAt(18, 59, 59), true},
+		{"end of peak", wednesdayAt(19, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClock(t, tt.now)
+			for id, fee := range allShippingFees(t) {
+				want := offPeak[id]
+				if tt.peak {
+					want += peakHours.Surcharge
+				}
+				if fee != want {
+					t.Errorf("product %d: fee %v, want %v", id, fee, want)
+				}
+			}
+		})
+	}
+}
+
+// TestPeakSurchargeHours checks the peak surcharge covers 2 PM up to, but not including, 7 PM,
+// as the shipping explanation says.
+func TestPeakSurchargeHours(t *testing.T) {
+	tests := []struct {
+		hour, minute int
+		want         Money
+	}{
+		{13, 59, 0},
+		{14, 0, peakHours.Surcharge},
+		{19, 0, 0},
+		{19, 59, 0},
+	}
+	for _, tt := range tests {
+		b := calculateShippingFee("Electronics", 1, false, nil, 0, wednesdayAt(tt.hour, tt.minute, 0))
+		if b.PeakSurcharge != tt.want {
+			t.Errorf("%02d:%02d: peak surcharge %v, want %v", tt.hour, tt.minute, b.PeakSurcharge, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleShippingExplanation(rec, httptest.NewRequest(http.MethodGet, "/shipping-explanation", nil))
+	if want := "peak hours from 2 PM to 7 PM"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("explanation %s does not mention %q", rec.Body, want)
+	}
+}
+
+// TestShippingFeeUsesClock checks /shipping-fee prices at the injected clock's time rather than the wall clock.
+func TestShippingFeeUsesClock(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		wantPeak Money
+		wantFee  Money
+	}{
+		{"morning", wednesdayAt(9, 30, 0), 0, 1015},
+		{"peak", wednesdayAt(16, 45, 0), 300, 1315},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClock(t, tt.now)
+			rec := httptest.NewRecorder()
+			handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var body struct {
+				ShippingFee Money        `json:"shipping_fee"`
+				Breakdown   FeeBreakdown `json:"breakdown"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Breakdown.PeakSurcharge != tt.wantPeak || body.ShippingFee != tt.wantFee {
+				t.Errorf("peak surcharge %v, fee %v; want %v, %v", body.Breakdown.PeakSurcharge, body.ShippingFee, tt.wantPeak, tt.wantFee)
+			}
+		})
+	}
+}
+
+// useStore swaps in a fresh in-memory catalog seeded with seedProducts for the rest of the test.
+func useStore(t testing.TB) *memoryStore {
+	t.Helper()
+	prev := store
+	s := newMemoryStore(seedProducts)
+	store = s
+	t.Cleanup(func() { store = prev })
+	return s
+}
+
+// TestMemoryStoreConcurrentAccess mixes fee reads with catalog writes; run it with -race.
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(15, 0, 0))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for target, h := range map[string]http.HandlerFunc{
+					"/all-shipping-fees":         handleAllShippingFees,
+					"/shipping-fee?product_id=1": handleShippingFee,
+				} {
+					rec := httptest.NewRecorder()
+					h(rec, httptest.NewRequest(http.MethodGet, target, nil))
+					if rec.Code != http.StatusOK {
+						t.Errorf("GET %s: status %d", target, rec.Code)
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p, err := s.Create(ctx, Product{Name: "Widget", Price: 5, Category: "Fitness", Weight: 1})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				p.Price = 6
+				if _, err := s.Update(ctx, p); err != nil {
+					t.Error(err)
+				}
+				if err := s.Delete(ctx, p.ID); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := s.List(ctx); len(got) != len(seedProducts) {
+		t.Errorf("catalog has %d products after matching creates and deletes, want %d", len(got), len(seedProducts))
+	}
+}
+
+// TestCartTotalsExactly checks that a 100-item cart's subtotal is exactly 100 item fees,
+// which summing float dollars (e.g. 100 x 10.15) would miss by a fraction of a cent.
+func TestCartTotalsExactly(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	tests := []struct {
+		productID string
+		itemFee   Money
+	}{
+		{"1", 1015},
+		{"12", 1035},
+	}
+	for _, tt := range tests {
+		t.Run("product "+tt.productID, func(t *testing.T) {
+			target := "/shipping-fee?product_id=" + tt.productID + strings.Repeat("&product_id="+tt.productID, 99)
+			rec := httptest.NewRecorder()
+			handleShippingFee(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var body struct {
+				Items []struct {
+					ShippingFee Money `json:"shipping_fee"`
+				} `json:"items"`
+				Subtotal       Money `json:"subtotal"`
+				BundleDiscount Money `json:"bundle_discount"`
+				Total          Money `json:"total"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			var sum Money
+			for _, item := range body.Items {
+				sum = sum.Add(item.ShippingFee)
+			}
+			want := 100 * tt.itemFee
+			if len(body.Items) != 100 || sum != want || body.Subtotal != want {
+				t.Errorf("%d items summing to %v, subtotal %v; want 100 items, %v", len(body.Items), sum, body.Subtotal, want)
+			}
+			if body.Total != want-body.BundleDiscount {
+				t.Errorf("total %v, want subtotal %v less bundle discount %v", body.Total, want, body.BundleDiscount)
+			}
+		})
+	}
+}
+
+// setRoundingMode switches roundingMode for the rest of the test.
+func setRoundingMode(t testing.TB, mode string) {
+	t.Helper()
+	prev := roundingMode
+	roundingMode = mode
+	t.Cleanup(func() { roundingMode = prev })
+}
+
+func TestRoundingModes(t *testing.T) {
+	tests := []struct {
+		cents                 float64
+		halfUp, bankers, ceil float64
+	}{
+		{2.5, 3, 2, 3},
+		{3.5, 4, 4, 4},
+		{12.5, 13, 12, 13}, // $0.125
+		{2.4, 2, 2, 3},
+		{550.0000000001, 550, 550, 550}, // 500 * 1.1 in float64
+		{-2.5, -3, -2, -2},
+	}
+	for _, tt := range tests {
+		for mode, want := range map[string]float64{"half_up": tt.halfUp, "bankers": tt.bankers, "ceil": tt.ceil} {
+			if got := roundingModes[mode](tt.cents); got != want {
+				t.Errorf("%s(%g) = %g, want %g", mode, tt.cents, got, want)
+			}
+		}
+	}
+}
+
+// TestQuoteRoundsOnce checks the rounding mode applies to the final fee, not to every intermediate step.
+func TestQuoteRoundsOnce(t *testing.T) {
+	product := Product{Category: "Electronics", Weight: 0.011}
+	origin := Warehouse{Multiplier: 1.001}
+	speed := SpeedTier{Multiplier: 1.001}
+	zone := Zone{Multiplier: 1}
+
+	// (1000 + 0.55) * 1.001 * 1.001 = 1002.55... cents; rounding every step up would give 1005
+	tests := []struct {
+		mode string
+		want Money
+	}{
+		{"half_up", 1003},
+		{"bankers", 1003},
+		{"ceil", 1003},
+	}
+	for _, tt := range tests {
+		setRoundingMode(t, tt.mode)
+		q := quoteShipping(product, origin, speed, zone, 0, wednesdayAt(9, 0, 0))
+		if q.Fee != tt.want {
+			t.Errorf("%s: fee %v, want %v", tt.mode, q.Fee, tt.want)
+		}
+		if sum := q.Breakdown.Calculated + q.OriginSurcharge + q.SpeedSurcharge + q.ZoneSurcharge; sum != q.Fee {
+			t.Errorf("%s: calculated fee and surcharges sum to %v, want the fee %v", tt.mode, sum, q.Fee)
+		}
+	}
+}
+
+// restoreConfig puts back the settings loadConfig assigns even when their variables are unset.
+func restoreConfig(t testing.TB) {
+	t.Helper()
+	prevTLSCert, prevTLSKey := tlsCertFile, tlsKeyFile
+	prevOrigins, prevMetricsToken := allowedOrigins, metricsAuthToken
+	prevPeak, prevLocation := peakHours, shippingLocation
+	prevChaosLatency, prevSecret := chaosLatency, jwtSecret
+	t.Cleanup(func() {
+		tlsCertFile, tlsKeyFile = prevTLSCert, prevTLSKey
+		allowedOrigins, metricsAuthToken = prevOrigins, prevMetricsToken
+		peakHours, shippingLocation = prevPeak, prevLocation
+		chaosLatency, jwtSecret = prevChaosLatency, prevSecret
+	})
+}
+
+// TestLoadConfigReportsAllErrors checks that every invalid setting is reported in one error,
+// not just the first one found.
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "parse errors",
+			env: map[string]string{
+				"ROUNDING_MODE":     "sideways",
+				"SHUTDOWN_TIMEOUT":  "soon",
+				"WEEKEND_SURCHARGE": "-1",
+				"TLS_CERT_FILE":     "cert.pem",
+				"PEAK_HOURS_END":    "noon",
+			},
+			want: []string{"ROUNDING_MODE", "SHUTDOWN_TIMEOUT", "WEEKEND_SURCHARGE", "TLS_CERT_FILE and TLS_KEY_FILE", `PEAK_HOURS_END: "noon" is not an HH:MM time`},
+		},
+		{
+			name: "parse and cross-field errors",
+			env: map[string]string{
+				"SEASONAL_SURCHARGES":         `[{"name":"winter","start":"2026-12-31","end":"2026-12-01","surcharge":1}]`,
+				"AGE_VERIFICATION_CATEGORIES": "Spirits",
+				"ROUNDING_MODE":               "sideways",
+				"PEAK_HOURS_START":            "20:00",
+				"PEAK_HOURS_END":              "08:00",
+			},
+			want: []string{`"winter": end is before start`, `AGE_VERIFICATION_CATEGORIES: unknown category "Spirits"`, "ROUNDING_MODE", "peak hours 8 PM-8 AM: start is after end"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreConfig(t)
+			prevSeasons, prevAge := seasons, ageVerificationCategories
+			t.Cleanup(func() { seasons, ageVerificationCategories = prevSeasons, prevAge })
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			err := loadConfig()
+			if err == nil {
+				t.Fatal("loadConfig succeeded, want errors")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfigReportsAllErrors(t *testing.T) {
+	prevBase, prevDefault, prevCOD := baseFee, defaultCategoryMultiplier, codFee
+	prevCODType, prevLimits := codFeeType, categoryFeeLimits
+	t.Cleanup(func() {
+		baseFee, defaultCategoryMultiplier, codFee = prevBase, prevDefault, prevCOD
+		codFeeType, categoryFeeLimits = prevCODType, prevLimits
+	})
+	baseFee, defaultCategoryMultiplier = -1, 0
+	codFeeType, codFee = "percent", 150
+	categoryFeeLimits = map[string]FeeLimits{"Fitness": {MinFee: 900, MaxFee: 500}}
+
+	errs := validateConfig()
+	for _, want := range []string{
+		"base fee must not be negative",
+		"DEFAULT_CATEGORY_MULTIPLIER must be positive",
+		"COD_FEE: 150% exceeds 100%",
+		`CATEGORY_FEE_LIMITS: min_fee for "Fitness" is above its max_fee`,
+	} {
+		found := false
+		for _, err := range errs {
+			found = found || err.Error() == want
+		}
+		if !found {
+			t.Errorf("validateConfig() = %v, missing %q", errs, want)
+		}
+	}
+	if len(errs) != 4 {
+		t.Errorf("validateConfig() reported %d errors, want 4: %v", len(errs), errs)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		allowUnknown bool
+		want         string // "" for success
+	}{
+		{"valid", `{"name":"Lamp","price":9.5}`, false, ""},
+		{"syntax error", `{"name":"Lamp",}`, false, "invalid JSON at offset 16: invalid character '}'"},
+		{"truncated", `{"name":"Lamp"`, false, "invalid JSON: unexpected end of body"},
+		{"wrong body type", `["Lamp"]`, false, "invalid JSON at offset 1: body must be of type"},
+		{"wrong field type", `{"price":"cheap"}`, false, `invalid JSON at offset 16: field "price" must be of type float64`},
+		{"unknown field", `{"name":"Lamp","colour":"red"}`, false, `invalid JSON: unknown field "colour"`},
+		{"unknown field allowed", `{"name":"Lamp","colour":"red"}`, true, ""},
+		{"empty body", ``, false, "request body must not be empty"},
+		{"trailing value", `{"name":"Lamp"} {}`, false, "request body must contain a single JSON value"},
+		{"too large", `{"name":"` + strings.Repeat("x", 64) + `"}`, false, "request body too large: limit is 32 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := disallowUnknownFields
+			disallowUnknownFields = !tt.allowUnknown
+			t.Cleanup(func() { disallowUnknownFields = prev })
+
+			r := httptest.NewRequest(http.MethodPost, "/estimate", strings.NewReader(tt.body))
+			r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 32)
+			var dst struct {
+				Name  string  `json:"name"`
+				Price float64 `json:"price"`
+			}
+			err := decodeJSON(r, &dst)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("decodeJSON(%s) = %v, want success", tt.body, err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("decodeJSON(%s) = %v, want %q", tt.body, err, tt.want)
+			}
+		})
+	}
+}
+
+// signJWT returns an HS256 token for claims signed with secret.
+func signJWT(t testing.TB, claims map[string]any, secret string) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequireAuth(t *testing.T) {
+	now := wednesdayAt(12, 0, 0)
+	setClock(t, now)
+	prevSecret := jwtSecret
+	jwtSecret = []byte("test-secret")
+	t.Cleanup(func() { jwtSecret = prevSecret })
+
+	valid := signJWT(t, map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix()}, "test-secret")
+	tampered := valid[:strings.LastIndex(valid, ".")] + "." + base64.RawURLEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		want   int
+	}{
+		{"valid token", http.MethodPost, "Bearer " + valid, http.StatusOK},
+		{"expired token", http.MethodPost, "Bearer " + signJWT(t, map[string]any{"sub": "alice", "exp": now.Add(-time.Second).Unix()}, "test-secret"), http.StatusUnauthorized},
+		{"tampered signature", http.MethodPost, "Bearer " + tampered, http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "Bearer " + signJWT(t, map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix()}, "other-secret"), http.StatusUnauthorized},
+		{"missing token", http.MethodPost, "", http.StatusUnauthorized},
+		{"public read", http.MethodGet, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var subject string
+			h := requireAuth(func(w http.ResponseWriter, r *http.Request) { subject = authSubject(r) })
+			req := httptest.NewRequest(tt.method, "/products", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && tt.auth != "" && subject != "alice" {
+				t.Errorf("subject %q, want alice", subject)
+			}
+		})
+	}
+}
+
+// TestFeesCacheBustedByMutations checks repeated listings are served from cache until a product is
+// created, updated or deleted.
+func TestFeesCacheBustedByMutations(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(10, 0, 0))
+	feesCache.purge()
+	t.Cleanup(feesCache.purge)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/all-shipping-fees", cacheResponses(feesCache, handleAllShippingFees))
+	mux.HandleFunc("/products", handleCreateProduct)
+	mux.HandleFunc("/products/{id}", handleProduct)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status %d: %s", method, target, rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	first := do(http.MethodGet, "/all-shipping-fees", "")
+	second := do(http.MethodGet, "/all-shipping-fees", "")
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache %q then %q, want MISS then HIT", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Fatalf("cached body differs:\n%s\n%s", first.Body, second.Body)
+	}
+
+	tests := []struct {
+		name, method, target, body string
+	}{
+		{"create", http.MethodPost, "/products", `{"name":"Kettlebell","price":40,"category":"Fitness","weight":8}`},
+		{"update", http.MethodPut, "/products/13", `{"name":"Kettlebell","price":40,"category":"Fitness","weight":12}`},
+		{"delete", http.MethodDelete, "/products/13", ""},
+	}
+	prev := second.Body.String()
+	for _, tt := range tests {
+		do(tt.method, tt.target, tt.body)
+		rec := do(http.MethodGet, "/all-shipping-fees", "")
+		if got := rec.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("after %s: X-Cache %q, want MISS", tt.name, got)
+		}
+		if rec.Body.String() == prev {
+			t.Errorf("after %s: listing unchanged", tt.name)
+		}
+		prev = rec.Body.String()
+	}
+}
+
+// TestMinutePeakHours checks a 14:30-19:15 window at minute granularity, and that cached listings
+// don't carry a fee across its edges within the hour.
+func TestMinutePeakHours(t *testing.T) {
+	restoreConfig(t)
+	t.Setenv("PEAK_HOURS_START", "14:30")
+	t.Setenv("PEAK_HOURS_END", "19:15")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now  time.Time
+		peak bool
+	}{
+		{wednesdayAt(14, 29, 59), false},
+		{wednesdayAt(14, 30, 0), true},
+		{wednesdayAt(19, 14, 59), true},
+		{wednesdayAt(19, 15, 0), false},
+	}
+	for _, tt := range tests {
+		b := calculateShippingFee("Fitness", 1, false, nil, 0, tt.now)
+		if got := b.PeakSurcharge > 0; got != tt.peak {
+			t.Errorf("%s: peak surcharge %v, want peak %t", tt.now.Format("15:04:05"), b.PeakSurcharge, tt.peak)
+		}
+		if inside, outside := feePeriod(tt.now), feePeriod(tt.now.Add(-time.Second)); tt.now.Second() == 0 && inside == outside {
+			t.Errorf("%s: cache period %q is shared with the second before", tt.now.Format("15:04:05"), inside)
+		}
+	}
+}
+
+// TestAtHour checks that at_hour quotes the fee at that time of day, to the minute, and rejects invalid times.
+func TestAtHour(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(3, 0, 0))
+	prev := peakHours
+	t.Cleanup(func() { peakHours = prev })
+	peakHours = PeakHours{Start: 14*60 + 30, End: 19*60 + 15, Surcharge: 300}
+
+	tests := []struct {
+		atHour string
+		peak   bool
+	}{
+		{"9", false},
+		{"14", false},
+		{"14:29", false},
+		{"14:30", true},
+		{"17", true},
+		{"19:14", true},
+		{"19:15", false},
+	}
+	for _, tt := range tests {
+		quote := getShippingFee(t, "/shipping-fee?product_id=1&at_hour="+tt.atHour)
+		if got := quote.Breakdown.PeakSurcharge > 0; got != tt.peak {
+			t.Errorf("at_hour=%s: peak surcharge %v, want peak %t", tt.atHour, quote.Breakdown.PeakSurcharge, tt.peak)
+		}
+	}
+
+	for _, atHour := range []string{"24", "7:60", "noon", "-1"} {
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1&at_hour="+atHour, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("at_hour=%s: status %d, want %d", atHour, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestCustomPeakHours checks that a peak window configured away from the default moves the peak surcharge with it.
+func TestCustomPeakHours(t *testing.T) {
+	useStore(t)
+	restoreConfig(t)
+	t.Setenv("PEAK_HOURS_START", "06:00")
+	t.Setenv("PEAK_HOURS_END", "08:30")
+	t.Setenv("PEAK_SURCHARGE", "4.50")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now  time.Time
+		peak Money
+	}{
+		{wednesdayAt(5, 59, 0), 0},
+		{wednesdayAt(7, 0, 0), 450},
+		{wednesdayAt(8, 29, 0), 450},
+		{wednesdayAt(15, 0, 0), 0}, // inside the default window
+	}
+	for _, tt := range tests {
+		t.Run(tt.now.Format("15:04"), func(t *testing.T) {
+			setClock(t, tt.now)
+			offPeak := getShippingFee(t, "/shipping-fee?product_id=1&at_hour=12")
+			quote := getShippingFee(t, "/shipping-fee?product_id=1")
+			if quote.Breakdown.PeakSurcharge != tt.peak {
+				t.Errorf("peak surcharge %v, want %v", quote.Breakdown.PeakSurcharge, tt.peak)
+			}
+			if tt.peak > 0 && quote.ShippingFee <= offPeak.ShippingFee {
+				t.Errorf("fee %v in the custom window, want more than the off-peak %v", quote.ShippingFee, offPeak.ShippingFee)
+			}
+		})
+	}
+}
+
+// TestRecoverPanics checks a panicking handler answers 500, is counted in the request metrics,
+// and leaves the server serving later requests.
+func TestRecoverPanics(t *testing.T) {
+	const route = "/test-panic"
+	h := instrument(route, recoverPanics(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("panic") {
+			var m map[string]int
+			m["boom"]++ // nil map write
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?panic", http.StatusInternalServerError},
+		{"", http.StatusOK},
+		{"?panic", http.StatusInternalServerError},
+		{"", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.query)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.query, err)
+		}
+		var body map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.query, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusInternalServerError && body["error"] != "internal server error" {
+			t.Errorf("GET %s: body %v, want a JSON internal server error", tt.query, body)
+		}
+	}
+
+	if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(http.MethodGet, route, "500")); got != 2 {
+		t.Errorf("recorded %g 500s, want 2", got)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	tests := []struct {
+		name      string
+		enabled   bool
+		latency   time.Duration
+		errorRate float64
+		want      int
+		delayed   bool
+	}{
+		{"every request fails", true, 0, 1, http.StatusInternalServerError, false},
+		{"latency", true, latency, 0, http.StatusOK, true},
+		{"latency and errors", true, latency, 1, http.StatusInternalServerError, true},
+		{"disabled", false, latency, 1, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prevEnabled, prevLatency, prevRate := chaosEnabled, chaosLatency, chaosErrorRate
+			t.Cleanup(func() { chaosEnabled, chaosLatency, chaosErrorRate = prevEnabled, prevLatency, prevRate })
+			chaosEnabled, chaosLatency, chaosErrorRate = tt.enabled, tt.latency, tt.errorRate
+
+			h := chaos(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+			for i := 0; i < 3; i++ {
+				rec := httptest.NewRecorder()
+				start := time.Now()
+				h(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee", nil))
+				elapsed := time.Since(start)
+
+				if rec.Code != tt.want {
+					t.Fatalf("request %d: status %d, want %d", i, rec.Code, tt.want)
+				}
+				if delayed := elapsed >= latency; delayed != tt.delayed {
+					t.Fatalf("request %d took %v, want delayed by %v: %t", i, elapsed, latency, tt.delayed)
+				}
+			}
+		})
+	}
+}
+
+// feeQuote is the part of a /shipping-fee response the tests check.
+type feeQuote struct {
+	ShippingFee  Money        `json:"shipping_fee"`
+	FreeShipping bool         `json:"free_shipping"`
+	Breakdown    FeeBreakdown `json:"breakdown"`
+}
+
+// getShippingFee quotes target through handleShippingFee, failing the test unless it succeeds.
+func getShippingFee(t testing.TB, target string) feeQuote {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var quote feeQuote
+	if err := json.Unmarshal(rec.Body.Bytes(), &quote); err != nil {
+		t.Fatalf("decoding GET %s: %v", target, err)
+	}
+	return quote
+}
+
+// TestInsuranceFee checks that insured=true adds insurancePercent of the price as a breakdown line,
+// and that the breakdown's total is the fee charged with or without it.
+func TestInsuranceFee(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	tests := []struct {
+		price   float64
+		insured string
+		want    Money
+	}{
+		{20, "true", 20},
+		{40, "true", 40},
+		{40, "false", 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%g insured=%s", tt.price, tt.insured), func(t *testing.T) {
+			p, err := s.Create(context.Background(), Product{Name: "Lamp", Price: tt.price, Category: "Home", Weight: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", p.ID))
+			quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d&insured=%s", p.ID, tt.insured))
+			if quote.Breakdown.InsuranceFee != tt.want || quote.ShippingFee != base.ShippingFee+tt.want {
+				t.Errorf("insurance %v, fee %v; want %v on top of %v", quote.Breakdown.InsuranceFee, quote.ShippingFee, tt.want, base.ShippingFee)
+			}
+			if quote.Breakdown.Total != quote.ShippingFee {
+				t.Errorf("breakdown total %v, want the charged fee %v", quote.Breakdown.Total, quote.ShippingFee)
+			}
+		})
+	}
+}
+
+// TestCashOnDelivery checks that payment_method=cod adds the COD fee as a breakdown line in eligible zones
+// and is refused with 422 elsewhere.
+func TestCashOnDelivery(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	base := getShippingFee(t, "/shipping-fee?product_id=1&zone=national")
+	quote := getShippingFee(t, "/shipping-fee?product_id=1&zone=national&payment_method=cod")
+	if want := cashOnDeliveryFee(seedProducts[0].Price); quote.Breakdown.CODFee != want || quote.ShippingFee != base.ShippingFee+want {
+		t.Errorf("COD fee %v, fee %v; want %v on top of %v", quote.Breakdown.CODFee, quote.ShippingFee, want, base.ShippingFee)
+	}
+	if quote.Breakdown.Total != quote.ShippingFee {
+		t.Errorf("breakdown total %v, want the charged fee %v", quote.Breakdown.Total, quote.ShippingFee)
+	}
+
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1&zone=international&payment_method=cod", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("international COD: status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+// TestAppointmentDelivery checks that appointment=true adds the appointment fee as a breakdown line
+// for eligible categories and zones, and is refused with 422 otherwise.
+func TestAppointmentDelivery(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	base := getShippingFee(t, "/shipping-fee?product_id=7&zone=local")
+	quote := getShippingFee(t, "/shipping-fee?product_id=7&zone=local&appointment=true")
+	if quote.Breakdown.AppointmentFee != appointmentFee || quote.ShippingFee != base.ShippingFee+appointmentFee {
+		t.Errorf("appointment fee %v, fee %v; want %v on top of %v", quote.Breakdown.AppointmentFee, quote.ShippingFee, appointmentFee, base.ShippingFee)
+	}
+	if quote.Breakdown.Total != quote.ShippingFee {
+		t.Errorf("breakdown total %v, want the charged fee %v", quote.Breakdown.Total, quote.ShippingFee)
+	}
+
+	for _, target := range []string{
+		"/shipping-fee?product_id=1&zone=local&appointment=true",         // ineligible category
+		"/shipping-fee?product_id=7&zone=international&appointment=true", // ineligible zone
+	} {
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("GET %s: status %d, want %d", target, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+// TestFreeShippingWaivesAddOns checks that a product priced just over freeShippingThreshold is quoted
+// at 0 even with add-ons that would otherwise be charged, and one just under it pays them.
+func TestFreeShippingWaivesAddOns(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(20, 0, 0)) // off hours
+	prevThreshold, prevDispatch := freeShippingThreshold, offHoursDispatchSurcharge
+	freeShippingThreshold, offHoursDispatchSurcharge = 100, 500
+	t.Cleanup(func() { freeShippingThreshold, offHoursDispatchSurcharge = prevThreshold, prevDispatch })
+
+	tests := []struct {
+		price float64
+		free  bool
+	}{
+		{100, false},
+		{100.01, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.price), func(t *testing.T) {
+			p, err := s.Create(context.Background(), Product{Name: "Rack", Price: tt.price, Category: "Outdoor", Weight: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := fmt.Sprintf("/shipping-fee?product_id=%d&insured=true&payment_method=cod&appointment=true", p.ID)
+			quote := getShippingFee(t, target)
+			if quote.FreeShipping != tt.free {
+				t.Fatalf("free_shipping %v, want %v", quote.FreeShipping, tt.free)
+			}
+			if tt.free && quote.ShippingFee != 0 {
+				t.Errorf("free shipping charged %v", quote.ShippingFee)
+			}
+			if !tt.free && quote.Breakdown.DispatchSurcharge != 500 {
+				t.Errorf("dispatch surcharge %v, want 500", quote.Breakdown.DispatchSurcharge)
+			}
+			if fees := allShippingFees(t); (fees[p.ID] == 0) != tt.free {
+				t.Errorf("listed fee %v, want free shipping %v", fees[p.ID], tt.free)
+			}
+		})
+	}
+}
+
+// resetIdempotencyKeys starts the test with no stored Idempotency-Keys.
+func resetIdempotencyKeys(t testing.TB) {
+	t.Helper()
+	idempotencyMu.Lock()
+	prevKeys, prevOrder := idempotencyKeys, idempotencyOrder
+	idempotencyKeys, idempotencyOrder = map[string]*idempotentResult{}, nil
+	idempotencyMu.Unlock()
+	t.Cleanup(func() {
+		idempotencyMu.Lock()
+		idempotencyKeys, idempotencyOrder = prevKeys, prevOrder
+		idempotencyMu.Unlock()
+	})
+}
+
+// TestIdempotentCreate checks that repeating a create with the same Idempotency-Key
+// creates one product and replays the first response.
+func TestIdempotentCreate(t *testing.T) {
+	s := useStore(t)
+	resetIdempotencyKeys(t)
+	before := len(s.products)
+
+	h := idempotent(handleCreateProduct)
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`{"name":"Desk Lamp","description":"LED","price":25,"category":"Electronics","weight":1}`))
+		req.Header.Set("Idempotency-Key", "create-lamp")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("attempt %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("replayed body %s, want %s", bodies[1], bodies[0])
+	}
+	if created := len(s.products) - before; created != 1 {
+		t.Errorf("%d products created, want 1", created)
+	}
+}
+
+// TestIdempotencyKeysBounded checks that stored responses never exceed idempotencyMaxKeys
+// and that expired ones are dropped.
+func TestIdempotencyKeysBounded(t *testing.T) {
+	resetIdempotencyKeys(t)
+	now := time.Now()
+
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	storeIdempotentResult("expired", &idempotentResult{resp: &capturedResponse{}, expires: now.Add(-time.Second)}, now)
+	if _, ok := idempotencyKeys["expired"]; ok {
+		t.Error("expired key still stored")
+	}
+	for i := 0; i <= idempotencyMaxKeys; i++ {
+		storeIdempotentResult(fmt.Sprint(i), &idempotentResult{resp: &capturedResponse{}, expires: now.Add(time.Hour)}, now)
+	}
+	if len(idempotencyKeys) != idempotencyMaxKeys || len(idempotencyOrder) != idempotencyMaxKeys {
+		t.Errorf("%d keys, %d ordered; want %d", len(idempotencyKeys), len(idempotencyOrder), idempotencyMaxKeys)
+	}
+	if _, ok := idempotencyKeys["0"]; ok {
+		t.Error("oldest key not evicted")
+	}
+}
+
+// TestFeesCacheBounded checks that the response cache never holds more than feesCacheMaxEntries.
+func TestFeesCacheBounded(t *testing.T) {
+	cache := &responseCache{entries: map[string]cachedResponse{}}
+	now := time.Now()
+
+	cache.put("expired", &capturedResponse{}, now.Add(-2*feesCacheTTL))
+	for i := 0; i <= feesCacheMaxEntries; i++ {
+		cache.put(fmt.Sprint(i), &capturedResponse{}, now)
+	}
+	if len(cache.entries) != feesCacheMaxEntries || len(cache.order) != feesCacheMaxEntries {
+		t.Errorf("%d entries, %d ordered; want %d", len(cache.entries), len(cache.order), feesCacheMaxEntries)
+	}
+	for _, key := range []string{"expired", "0"} {
+		if _, ok := cache.entries[key]; ok {
+			t.Errorf("%q not evicted", key)
+		}
+	}
+	if _, ok := cache.get(fmt.Sprint(feesCacheMaxEntries), now); !ok {
+		t.Error("newest entry missing")
+	}
+}
+
+// TestLoadDuplicateIDs checks each duplicateIDPolicy on a products file with two products sharing ID 1.
+func TestLoadDuplicateIDs(t *testing.T) {
+	path := t.TempDir() + "/products.json"
+	data := `[{"id":1,"name":"First"},{"id":2,"name":"Other"},{"id":1,"name":"Last"}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := duplicateIDPolicy
+	t.Cleanup(func() { duplicateIDPolicy = prev })
+
+	tests := []struct {
+		policy  string
+		wantErr bool
+		want    []string
+	}{
+		{"fail", true, nil},
+		{"keep-first", false, []string{"First", "Other"}},
+		{"keep-last", false, []string{"Last", "Other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			duplicateIDPolicy = tt.policy
+			s := newMemoryStore(nil)
+			err := s.load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load: %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var names []string
+			for _, p := range s.products {
+				names = append(names, p.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("loaded %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+// TestDominantCartPricing checks that a mixed cart priced as "dominant" is quoted as one package
+// at the highest-multiplier category's rate, and reports that category.
+func TestDominantCartPricing(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prev := cartPricing
+	cartPricing = "dominant"
+	t.Cleanup(func() { cartPricing = prev })
+
+	// headphones (Electronics) and an office chair (Office Supplies)
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1&product_id=7", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		PricingMode string `json:"pricing_mode"`
+		Shipments   []struct {
+			DominantCategory string       `json:"dominant_category"`
+			Package          FeeBreakdown `json:"package"`
+		} `json:"shipments"`
+		Subtotal       Money `json:"subtotal"`
+		BundleDiscount Money `json:"bundle_discount"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Shipments) != 1 {
+		t.Fatalf("%d shipments, want 1", len(body.Shipments))
+	}
+	shipment := body.Shipments[0]
+
+	want := "Electronics"
+	if categoryMultiplier("Office Supplies") > categoryMultiplier("Electronics") {
+		want = "Office Supplies"
+	}
+	if body.PricingMode != "dominant" || shipment.DominantCategory != want {
+		t.Errorf("pricing mode %q, dominant category %q; want dominant, %q", body.PricingMode, shipment.DominantCategory, want)
+	}
+	pkg := Product{Category: want, Weight: seedProducts[0].Weight + seedProducts[6].Weight}
+	if fee := calculateShippingFee(pkg.Category, pkg.Weight, false, nil, handlingFee, wednesdayAt(9, 30, 0)).Calculated; body.Subtotal != fee || shipment.Package.Total != fee {
+		t.Errorf("subtotal %v, package total %v; want one %s package at %v", body.Subtotal, shipment.Package.Total, want, fee)
+	}
+	if body.BundleDiscount != 0 {
+		t.Errorf("bundle discount %v on a single package", body.BundleDiscount)
+	}
+}
+
+// TestEstimateMissingPrice checks each estimateMissingPrice policy for an estimate without a price.
+func TestEstimateMissingPrice(t *testing.T) {
+	setClock(t, wednesdayAt(9, 30, 0))
+	prevPolicy, prevAssumed, prevThreshold := estimateMissingPrice, estimateAssumedPrice, freeShippingThreshold
+	estimateAssumedPrice, freeShippingThreshold = 100, 50
+	t.Cleanup(func() {
+		estimateMissingPrice, estimateAssumedPrice, freeShippingThreshold = prevPolicy, prevAssumed, prevThreshold
+	})
+
+	tests := []struct {
+		policy      string
+		wantStatus  int
+		wantFree    bool
+		wantSkipped []string
+	}{
+		{"skip", http.StatusOK, false, []string{"free_shipping", "insurance"}},
+		{"require", http.StatusBadRequest, false, nil},
+		{"assume", http.StatusOK, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			estimateMissingPrice = tt.policy
+			rec := httptest.NewRecorder()
+			handleEstimate(rec, httptest.NewRequest(http.MethodPost, "/estimate", strings.NewReader(`{"category":"Electronics","weight":1,"insured":true}`)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var body struct {
+				FreeShipping      bool     `json:"free_shipping"`
+				PriceAssumed      bool     `json:"price_assumed"`
+				SkippedComponents []string `json:"skipped_components"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.FreeShipping != tt.wantFree || body.PriceAssumed != (tt.policy == "assume") || !slices.Equal(body.SkippedComponents, tt.wantSkipped) {
+				t.Errorf("free shipping %v, price assumed %v, skipped %q; want %v, %v, %q",
+					body.FreeShipping, body.PriceAssumed, body.SkippedComponents, tt.wantFree, tt.policy == "assume", tt.wantSkipped)
+			}
+		})
+	}
+}
+
+// TestFeeTraceLogging checks that FEE_TRACE_LOGGING logs one debug record per quote whose
+// steps run from the base fee to the charged fee, keyed by request ID.
+func TestFeeTraceLogging(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(16, 0, 0))
+	var logs bytes.Buffer
+	prevLogger, prevTrace := logger, feeTraceLogging
+	logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	feeTraceLogging = true
+	t.Cleanup(func() { logger, feeTraceLogging = prevLogger, prevTrace })
+
+	req := httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=6&speed=express&insured=true", nil)
+	req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, "trace-me"))
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, req)
+	var quote feeQuote
+	if err := json.Unmarshal(rec.Body.Bytes(), &quote); err != nil {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var record struct {
+		Msg       string    `json:"msg"`
+		RequestID string    `json:"request_id"`
+		Steps     []feeStep `json:"steps"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &record); err != nil {
+		t.Fatalf("decoding log %s: %v", logs.Bytes(), err)
+	}
+	if record.Msg != "fee trace" || record.RequestID != "trace-me" || len(record.Steps) == 0 {
+		t.Fatalf("logged %s, want a fee trace for request trace-me", logs.Bytes())
+	}
+	var total Money
+	for _, step := range record.Steps {
+		total = total.Add(step.Amount)
+		if step.RunningTotal != total {
+			t.Errorf("%s: running total %v, want %v", step.Component, step.RunningTotal, total)
+		}
+	}
+	if first, last := record.Steps[0], record.Steps[len(record.Steps)-1]; first.Component != "base_fee" || last.RunningTotal != quote.ShippingFee {
+		t.Errorf("steps run from %s to %v, want from base_fee to the fee %v", first.Component, last.RunningTotal, quote.ShippingFee)
+	}
+}
+
+// TestCouponPreview checks that /admin/coupon-preview requires a token, rejects invalid coupons,
+// and prices every catalog product with and without the coupon without saving it.
+func TestCouponPreview(t *testing.T) {
+	useStore(t)
+	now := wednesdayAt(9, 30, 0)
+	setClock(t, now)
+	prevSecret := jwtSecret
+	jwtSecret = []byte("test-secret")
+	t.Cleanup(func() { jwtSecret = prevSecret })
+	token := signJWT(t, map[string]any{"sub": "marketing", "exp": now.Add(time.Hour).Unix()}, "test-secret")
+	couponsBefore := len(coupons)
+
+	preview := func(body, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/coupon-preview", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		requireAuth(handleCouponPreview)(rec, req)
+		return rec
+	}
+
+	if rec := preview(`{"type":"percent","amount":10}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := preview(`{"type":"percent","amount":150}`, token); rec.Code != http.StatusBadRequest {
+		t.Errorf("150%% coupon: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec := preview(`{"type":"percent","amount":10}`, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Items []struct {
+			ProductID     int   `json:"product_id"`
+			CurrentFee    Money `json:"current_fee"`
+			DiscountedFee Money `json:"discounted_fee"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	current := allShippingFees(t)
+	if len(body.Items) != len(seedProducts) {
+		t.Fatalf("%d items, want %d", len(body.Items), len(seedProducts))
+	}
+	for _, item := range body.Items {
+		if item.CurrentFee != current[item.ProductID] || item.DiscountedFee >= item.CurrentFee {
+			t.Errorf("product %d: %v -> %v, want a discount on the listed %v", item.ProductID, item.CurrentFee, item.DiscountedFee, current[item.ProductID])
+		}
+	}
+	if len(coupons) != couponsBefore {
+		t.Error("previewed coupon was saved")
+	}
+}
+
+// TestWarehouseRouting checks that a product's own warehouse overrides the requested origin,
+// and that its route to the zone adds a surcharge and days on top of the warehouse's own.
+func TestWarehouseRouting(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prev := routes
+	routes = map[string]map[string]Route{"secondary": {"local": {Surcharge: 400, ExtraDays: 2}}}
+	t.Cleanup(func() { routes = prev })
+
+	remote, err := s.Create(context.Background(), Product{Name: "Chair", Price: 80, Category: "Furniture", Weight: 9, WarehouseID: "secondary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := s.Create(context.Background(), Product{Name: "Chair", Price: 80, Category: "Furniture", Weight: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type quote struct {
+		feeQuote
+		Warehouse string `json:"warehouse"`
+		MinDays   int    `json:"min_days"`
+		MaxDays   int    `json:"max_days"`
+	}
+	get := func(id int) quote {
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/shipping-fee?product_id=%d&origin=primary&zone=local", id), nil))
+		var q quote
+		if err := json.Unmarshal(rec.Body.Bytes(), &q); err != nil {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return q
+	}
+	fromPrimary, fromSecondary := get(local.ID), get(remote.ID)
+
+	if fromPrimary.Warehouse != "primary" || fromSecondary.Warehouse != "secondary" {
+		t.Errorf("fulfilled from %q and %q, want primary and secondary", fromPrimary.Warehouse, fromSecondary.Warehouse)
+	}
+	if fromSecondary.Breakdown.RouteSurcharge != 400 || fromSecondary.Breakdown.OriginSurcharge <= 0 || fromPrimary.Breakdown.RouteSurcharge != 0 {
+		t.Errorf("route surcharges %v and %v, origin surcharge %v; want 0, 400 and the secondary multiplier",
+			fromPrimary.Breakdown.RouteSurcharge, fromSecondary.Breakdown.RouteSurcharge, fromSecondary.Breakdown.OriginSurcharge)
+	}
+	if extra := warehouses["secondary"].DispatchDays + 2; fromSecondary.MinDays != fromPrimary.MinDays+extra || fromSecondary.MaxDays != fromPrimary.MaxDays+extra {
+		t.Errorf("window %d-%d days, want %d more than %d-%d", fromSecondary.MinDays, fromSecondary.MaxDays, extra, fromPrimary.MinDays, fromPrimary.MaxDays)
+	}
+}
+
+// TestHighTheftZones checks that quoting into a high-theft zone charges signature and insurance
+// even when not requested, and notes why in the breakdown.
+func TestHighTheftZones(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prev := highTheftZones
+	highTheftZones = map[string]bool{"local": true}
+	t.Cleanup(func() { highTheftZones = prev })
+
+	theft := getShippingFee(t, "/shipping-fee?product_id=1&zone=local")
+	if want := insuranceFee(seedProducts[0].Price); theft.Breakdown.SignatureFee != signatureFee || theft.Breakdown.InsuranceFee != want {
+		t.Errorf("signature %v, insurance %v; want %v, %v", theft.Breakdown.SignatureFee, theft.Breakdown.InsuranceFee, signatureFee, want)
+	}
+	if theft.Breakdown.Mandatory["signature_fee"] == "" || theft.Breakdown.Mandatory["insurance_fee"] == "" {
+		t.Errorf("mandatory %v, want reasons for signature_fee and insurance_fee", theft.Breakdown.Mandatory)
+	}
+	if theft.Breakdown.Total != theft.ShippingFee {
+		t.Errorf("breakdown total %v, want the charged fee %v", theft.Breakdown.Total, theft.ShippingFee)
+	}
+
+	other := getShippingFee(t, "/shipping-fee?product_id=1&zone=national")
+	if other.Breakdown.SignatureFee != 0 || other.Breakdown.InsuranceFee != 0 || other.Breakdown.Mandatory != nil {
+		t.Errorf("national zone charged signature %v, insurance %v, mandatory %v", other.Breakdown.SignatureFee, other.Breakdown.InsuranceFee, other.Breakdown.Mandatory)
+	}
+}
+
+// TestSplitShipments checks that a cart over PACKAGE_MAX_ITEMS is split into priced shipments
+// whose fees add up to the total, with the reason given.
+func TestSplitShipments(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prev := packageMaxItems
+	packageMaxItems = 2
+	t.Cleanup(func() { packageMaxItems = prev })
+
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1&product_id=2&product_id=3&product_id=4&product_id=5", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Shipments []struct {
+			Items   []int `json:"items"`
+			Fee     Money `json:"fee"`
+			MaxDays int   `json:"max_days"`
+		} `json:"shipments"`
+		SplitReason string `json:"split_reason"`
+		Total       Money  `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	var sum Money
+	for _, shipment := range body.Shipments {
+		sizes = append(sizes, len(shipment.Items))
+		sum = sum.Add(shipment.Fee)
+		if shipment.Fee <= 0 || shipment.MaxDays <= 0 {
+			t.Errorf("shipment %v: fee %v, max days %d", shipment.Items, shipment.Fee, shipment.MaxDays)
+		}
+	}
+	if !slices.Equal(sizes, []int{2, 2, 1}) {
+		t.Errorf("shipment sizes %v, want [2 2 1]", sizes)
+	}
+	if sum != body.Total {
+		t.Errorf("shipment fees sum to %v, want the total %v", sum, body.Total)
+	}
+	if want := "split into 3 packages of at most 2 items"; body.SplitReason != want {
+		t.Errorf("split reason %q, want %q", body.SplitReason, want)
+	}
+}
+
+// TestEstimatedDeliveryDays checks that estimated_delivery_days is the end of the delivery window,
+// so faster speeds arrive sooner and international delivery later.
+func TestEstimatedDeliveryDays(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	days := func(query string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id=1&"+query, nil))
+		var body struct {
+			EstimatedDeliveryDays int `json:"estimated_delivery_days"`
+			MaxDays               int `json:"max_days"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+		}
+		if body.EstimatedDeliveryDays != body.MaxDays {
+			t.Errorf("%s: estimated %d days, want max_days %d", query, body.EstimatedDeliveryDays, body.MaxDays)
+		}
+		return body.EstimatedDeliveryDays
+	}
+
+	standard, express, overnight := days("speed=standard"), days("speed=express"), days("speed=overnight")
+	if !(overnight < express && express < standard) {
+		t.Errorf("overnight %d, express %d, standard %d days; want each faster speed shorter", overnight, express, standard)
+	}
+	if national, international := days("zone=national"), days("zone=international"); international != national+zones["international"].ExtraDays {
+		t.Errorf("international %d days, want national %d plus %d", international, national, zones["international"].ExtraDays)
+	}
+}
+
+// TestRateLimit checks that a client over its burst gets 429 with Retry-After, while another client is unaffected.
+func TestRateLimit(t *testing.T) {
+	prevRPS, prevBurst, prevLimiter := rateLimitRPS, rateLimitBurst, limiter
+	rateLimitRPS, rateLimitBurst, limiter = 0.5, 2, &rateLimiter{buckets: map[string]*tokenBucket{}}
+	t.Cleanup(func() { rateLimitRPS, rateLimitBurst, limiter = prevRPS, prevBurst, prevLimiter })
+
+	h := rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/categories", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	for i := 0; i < rateLimitBurst; i++ {
+		if rec := get("203.0.113.7:4000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status %d", i+1, rec.Code)
+		}
+	}
+	rec := get("203.0.113.7:4001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("Retry-After %q, want 2 seconds at 0.5 requests per second", retry)
+	}
+	if rec := get("198.51.100.9:4000"); rec.Code != http.StatusOK {
+		t.Errorf("another client: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// TestProbeMethods checks that the health checks answer GET and HEAD and refuse other methods with 405 and Allow.
+func TestProbeMethods(t *testing.T) {
+	prev := ready.Load()
+	ready.Store(true)
+	t.Cleanup(func() { ready.Store(prev) })
+
+	for pattern, h := range map[string]http.HandlerFunc{"/healthz": handleHealthz, "/readyz": handleReadyz} {
+		h := probe(pattern, h)
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(method, pattern, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s %s: status %d, want %d", method, pattern, rec.Code, http.StatusOK)
+			}
+		}
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(method, pattern, nil))
+			if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+				t.Errorf("%s %s: status %d, Allow %q; want %d and GET, HEAD", method, pattern, rec.Code, rec.Header().Get("Allow"), http.StatusMethodNotAllowed)
+			}
+		}
+	}
+}
+
+// TestAgeVerification checks that a configured category or tag adds the age-verification fee as a mandatory
+// breakdown line, and that zones and speeds where a courier can't check ID are refused with 422.
+func TestAgeVerification(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prevCategories, prevTags := ageVerificationCategories, ageVerificationTags
+	ageVerificationCategories, ageVerificationTags = map[string]bool{"Books": true}, map[string]bool{"alcohol": true}
+	t.Cleanup(func() { ageVerificationCategories, ageVerificationTags = prevCategories, prevTags })
+
+	wine, err := s.Create(context.Background(), Product{Name: "Wine", Price: 15, Category: "Home", Weight: 1, Tags: []string{"Alcohol"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := s.Create(context.Background(), Product{Name: "Vase", Price: 15, Category: "Home", Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	novel, err := s.Create(context.Background(), Product{Name: "Novel", Price: 15, Category: "Books", Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []Product{wine, novel} {
+		quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", p.ID))
+		if quote.Breakdown.AgeVerificationFee != ageVerificationFee || quote.Breakdown.Mandatory["age_verification_fee"] == "" {
+			t.Errorf("%s: age verification %v, mandatory %v; want %v with a reason", p.Name, quote.Breakdown.AgeVerificationFee, quote.Breakdown.Mandatory, ageVerificationFee)
+		}
+		if quote.Breakdown.Total != quote.ShippingFee {
+			t.Errorf("%s: breakdown total %v, want the charged fee %v", p.Name, quote.Breakdown.Total, quote.ShippingFee)
+		}
+	}
+	if quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", plain.ID)); quote.Breakdown.AgeVerificationFee != 0 || quote.Breakdown.Mandatory != nil {
+		t.Errorf("untagged product charged %v, mandatory %v", quote.Breakdown.AgeVerificationFee, quote.Breakdown.Mandatory)
+	}
+
+	refused := []string{
+		fmt.Sprintf("/shipping-fee?product_id=%d&zone=international", wine.ID),
+		fmt.Sprintf("/shipping-fee?product_id=%d&speed=overnight", novel.ID),
+		fmt.Sprintf("/shipping-fee?product_id=%d&product_id=%d&zone=international", plain.ID, wine.ID),
+	}
+	for _, target := range refused {
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("GET %s: status %d, want %d", target, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/shipping-fee?product_id=%d&zone=international", plain.ID), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("untagged product to international: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	for zone, want := range map[string]int{"local": http.StatusOK, "international": http.StatusUnprocessableEntity} {
+		body := fmt.Sprintf(`{"category":"Home","price":15,"weight":1,"tags":["alcohol"],"zone":%q}`, zone)
+		rec := httptest.NewRecorder()
+		handleEstimate(rec, httptest.NewRequest(http.MethodPost, "/estimate", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Errorf("estimate to %s: status %d, want %d", zone, rec.Code, want)
+		}
+		if want == http.StatusOK && !strings.Contains(rec.Body.String(), `"mandatory":{"age_verification_fee"`) {
+			t.Errorf("estimate to %s: %s, want a mandatory age_verification_fee", zone, rec.Body)
+		}
+	}
+}
+
+// TestDispatchSurcharge checks that orders placed outside business hours or on a weekend pay the
+// off-hours dispatch surcharge as its own breakdown line, separate from the weekend surcharge.
+func TestDispatchSurcharge(t *testing.T) {
+	useStore(t)
+	prevDispatch, prevWeekend := offHoursDispatchSurcharge, weekendSurcharge
+	offHoursDispatchSurcharge, weekendSurcharge = 400, 250
+	t.Cleanup(func() { offHoursDispatchSurcharge, weekendSurcharge = prevDispatch, prevWeekend })
+
+	saturday := wednesdayAt(12, 0, 0).AddDate(0, 0, 3)
+	tests := []struct {
+		name     string
+		now      time.Time
+		dispatch Money
+		weekend  Money
+	}{
+		{"business hours", wednesdayAt(9, 0, 0), 0, 0},
+		{"last minute", wednesdayAt(16, 59, 59), 0, 0},
+		{"before opening", wednesdayAt(8, 59, 59), 400, 0},
+		{"after closing", wednesdayAt(17, 0, 0), 400, 0},
+		{"saturday", saturday, 400, 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClock(t, tt.now)
+			quote := getShippingFee(t, "/shipping-fee?product_id=1")
+			if quote.Breakdown.DispatchSurcharge != tt.dispatch || quote.Breakdown.WeekendSurcharge != tt.weekend {
+				t.Errorf("dispatch %v, weekend %v; want %v, %v", quote.Breakdown.DispatchSurcharge, quote.Breakdown.WeekendSurcharge, tt.dispatch, tt.weekend)
+			}
+			if quote.Breakdown.Total != quote.ShippingFee {
+				t.Errorf("breakdown total %v, want the charged fee %v", quote.Breakdown.Total, quote.ShippingFee)
+			}
+		})
+	}
+}
+
+// TestShippingLocationDecidesPeak checks that peak hours follow the wall clock in shippingLocation, not UTC.
+func TestShippingLocationDecidesPeak(t *testing.T) {
+	useStore(t)
+
+	tests := []struct {
+		utcHour  int
+		location *time.Location
+		peak     bool
+	}{
+		{20, time.UTC, false},
+		{20, time.FixedZone("UTC-5", -5*60*60), true}, // 3 PM
+		{10, time.UTC, false},
+		{10, time.FixedZone("UTC+5", 5*60*60), true},  // 3 PM
+		{15, time.FixedZone("UTC+5", 5*60*60), false}, // 8 PM
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%02d:00 UTC in %s", tt.utcHour, tt.location), func(t *testing.T) {
+			setClock(t, wednesdayAt(tt.utcHour, 0, 0))
+			shippingLocation = tt.location
+			quote := getShippingFee(t, "/shipping-fee?product_id=1")
+			if got := quote.Breakdown.PeakSurcharge > 0; got != tt.peak {
+				t.Errorf("peak surcharge %v, want peak %t", quote.Breakdown.PeakSurcharge, tt.peak)
+			}
+		})
+	}
+}
+
+// TestCORSOrigins checks that ALLOWED_ORIGINS echoes only listed origins, and that an empty list or "*" allows any.
+func TestCORSOrigins(t *testing.T) {
+	prev := allowedOrigins
+	t.Cleanup(func() { allowedOrigins = prev })
+
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    string
+	}{
+		{"allowed", []string{"https://shop.example", "https://admin.example"}, "https://admin.example", "https://admin.example"},
+		{"disallowed", []string{"https://shop.example"}, "https://evil.example", ""},
+		{"no origin", []string{"https://shop.example"}, "", ""},
+		{"wildcard", []string{"*"}, "https://evil.example", "*"},
+		{"unset", nil, "https://evil.example", "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedOrigins = tt.allowed
+			h := corsMiddleware("GET, OPTIONS", func(w http.ResponseWriter, r *http.Request) {})
+			for _, method := range []string{http.MethodGet, http.MethodOptions} {
+				req := httptest.NewRequest(method, "/categories", nil)
+				if tt.origin != "" {
+					req.Header.Set("Origin", tt.origin)
+				}
+				rec := httptest.NewRecorder()
+				h(rec, req)
+				if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+					t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", method, got, tt.want)
+				}
+				if tt.want != "*" && !slices.Contains(rec.Header().Values("Vary"), "Origin") {
+					t.Errorf("%s: Vary %q, want Origin for a per-origin response", method, rec.Header().Values("Vary"))
+				}
+			}
+		})
+	}
+}
+
+// TestShippingFeeProductID checks that product_id is parsed as an integer: leading zeros still find
+// the product, anything non-numeric is a 400, and an unknown ID is a 404.
+func TestShippingFeeProductID(t *testing.T) {
+	useStore(t)
+
+	tests := []struct {
+		id     string
+		status int
+	}{
+		{"1", http.StatusOK},
+		{"01", http.StatusOK},
+		{"1.0", http.StatusBadRequest},
+		{"abc", http.StatusBadRequest},
+		{"999999", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleShippingFee(rec, httptest.NewRequest(http.MethodGet, "/shipping-fee?product_id="+tt.id, nil))
+		if rec.Code != tt.status {
+			t.Errorf("product_id=%s: status %d, want %d", tt.id, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var body struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.ID != 1 {
+			t.Errorf("product_id=%s: quoted product %d, want 1", tt.id, body.ID)
+		}
+	}
+}
+
+// TestAllShippingFeesCSV checks that both CSV forms of /all-shipping-fees have the header row
+// and one row per product, with the same fees as the JSON listing.
+func TestAllShippingFeesCSV(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	if _, err := s.Create(context.Background(), Product{Name: "=SUM(A1:A9)", Price: 10, Category: "Home", Weight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := allShippingFees(t)
+
+	header := []string{"product_id", "shipping_fee", "price", "name", "description", "category", "weight", "free_shipping", "in_stock"}
+	for _, target := range []string{"/all-shipping-fees.csv", "/all-shipping-fees?format=csv"} {
+		rec := httptest.NewRecorder()
+		handleAllShippingFees(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", target, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("GET %s: Content-Type %q, want text/csv", target, ct)
+		}
+		if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, `filename="shipping-fees.csv"`) {
+			t.Errorf("GET %s: Content-Disposition %q, want a filename", target, cd)
+		}
+
+		rows, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("GET %s: %v", target, err)
+		}
+		if len(rows) == 0 || !slices.Equal(rows[0], header) {
+			t.Fatalf("GET %s: header %v, want %v", target, rows[:min(len(rows), 1)], header)
+		}
+		if len(rows)-1 != len(catalog) {
+			t.Errorf("GET %s: %d rows, want one per each of the %d products", target, len(rows)-1, len(catalog))
+		}
+		for _, row := range rows[1:] {
+			var id int
+			var fee float64
+			if _, err := fmt.Sscan(row[0], &id); err != nil {
+				t.Fatalf("GET %s: product_id %q: %v", target, row[0], err)
+			}
+			if _, err := fmt.Sscan(row[1], &fee); err != nil {
+				t.Fatalf("GET %s: shipping_fee %q: %v", target, row[1], err)
+			}
+			if MoneyFromFloat(fee) != want[id] {
+				t.Errorf("GET %s: product %d fee %v, want %v as in the JSON listing", target, id, fee, want[id])
+			}
+			if strings.HasPrefix(row[3], "=") {
+				t.Errorf("GET %s: name %q left as a formula", target, row[3])
+			}
+		}
+	}
+}
+
+// TestOversizedSurcharge checks that the camping tent (ID 11) pays the oversized handling surcharge
+// as its own breakdown line, and that no smaller seed product does.
+func TestOversizedSurcharge(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	for _, p := range seedProducts {
+		quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", p.ID))
+		want := Money(0)
+		if p.ID == 11 {
+			want = oversizedSurcharge
+		}
+		if quote.Breakdown.HandlingSurcharge != want {
+			t.Errorf("product %d (%s): handling surcharge %v, want %v", p.ID, p.Name, quote.Breakdown.HandlingSurcharge, want)
+		}
+	}
+
+	// an unflagged product is still oversized past oversizedSide
+	long, err := s.Create(context.Background(), Product{Name: "Kayak", Price: 400, Category: "Outdoor", Weight: 20, Length: oversizedSide + 1, Width: 60, Height: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", long.ID)); quote.Breakdown.HandlingSurcharge != oversizedSurcharge {
+		t.Errorf("%g cm product: handling surcharge %v, want %v", oversizedSide+1, quote.Breakdown.HandlingSurcharge, oversizedSurcharge)
+	}
+}
+
+// cartQuote is the part of a /shipping-fee cart response the cart tests check.
+type cartQuote struct {
+	Items []struct {
+		ID          int    `json:"id"`
+		ShippingFee *Money `json:"shipping_fee"`
+		Error       string `json:"error"`
+	} `json:"items"`
+	Subtotal       Money `json:"subtotal"`
+	BundleDiscount Money `json:"bundle_discount"`
+	Total          Money `json:"total"`
+}
+
+// getCart quotes the cart in target, failing the test unless it is answered with 200.
+func getCart(t testing.TB, target string) cartQuote {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleShippingFee(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var cart cartQuote
+	if err := json.Unmarshal(rec.Body.Bytes(), &cart); err != nil {
+		t.Fatalf("decoding GET %s: %v", target, err)
+	}
+	return cart
+}
+
+// TestCartReportsUnknownIDs checks that a cart with an unknown product ID is still quoted for its
+// other items, in request order, with the unknown one reported in place.
+func TestCartReportsUnknownIDs(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	cart := getCart(t, "/shipping-fee?product_id=1&product_id=999999&product_id=5")
+	if len(cart.Items) != 3 {
+		t.Fatalf("%d items, want 3", len(cart.Items))
+	}
+	if bad := cart.Items[1]; bad.ID != 999999 || bad.ShippingFee != nil || bad.Error != "Product not found" {
+		t.Errorf("unknown item %+v, want ID 999999 with no fee and Product not found", bad)
+	}
+
+	var sum Money
+	for _, n := range []int{0, 2} {
+		item := cart.Items[n]
+		if item.Error != "" || item.ShippingFee == nil {
+			t.Fatalf("item %d: %+v, want a fee", item.ID, item)
+		}
+		if single := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", item.ID)); *item.ShippingFee != single.ShippingFee {
+			t.Errorf("item %d: fee %v, want %v as quoted alone", item.ID, *item.ShippingFee, single.ShippingFee)
+		}
+		sum = sum.Add(*item.ShippingFee)
+	}
+	if cart.Items[0].ID != 1 || cart.Items[2].ID != 5 {
+		t.Errorf("items %d, %d; want 1, 5 in request order", cart.Items[0].ID, cart.Items[2].ID)
+	}
+	if cart.Subtotal != sum || cart.Total != sum-cart.BundleDiscount {
+		t.Errorf("subtotal %v, total %v; want %v less bundle discount %v", cart.Subtotal, cart.Total, sum, cart.BundleDiscount)
+	}
+}
+
+// TestBundleDiscount checks that the bundle discount grows with each additional item, and that
+// however large it is configured, it never takes a cart's total below zero.
+func TestBundleDiscount(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+
+	prevDiscount := Money(-1)
+	for count := 1; count <= 5; count++ {
+		cart := getCart(t, "/shipping-fee?product_id=1"+strings.Repeat("&product_id=1", count-1))
+		if count == 1 && cart.BundleDiscount != 0 {
+			t.Errorf("1 item: bundle discount %v, want none", cart.BundleDiscount)
+		}
+		if cart.BundleDiscount <= prevDiscount {
+			t.Errorf("%d items: bundle discount %v, want more than %v for one item fewer", count, cart.BundleDiscount, prevDiscount)
+		}
+		if cart.Total != cart.Subtotal-cart.BundleDiscount {
+			t.Errorf("%d items: total %v, want subtotal %v less %v", count, cart.Total, cart.Subtotal, cart.BundleDiscount)
+		}
+		prevDiscount = cart.BundleDiscount
+	}
+
+	prev := bundleDiscountPerItem
+	bundleDiscountPerItem = 1_000_000
+	t.Cleanup(func() { bundleDiscountPerItem = prev })
+	cart := getCart(t, "/shipping-fee?product_id=1&product_id=2&product_id=3")
+	if cart.BundleDiscount != cart.Subtotal || cart.Total != 0 {
+		t.Errorf("bundle discount %v, total %v; want the whole subtotal %v off and a zero total", cart.BundleDiscount, cart.Total, cart.Subtotal)
+	}
+	for _, count := range []int{0, 1} {
+		if d := bundleDiscount(count, 500); d != 0 {
+			t.Errorf("bundleDiscount(%d, 500) = %v, want 0", count, d)
+		}
+	}
+}
+
+// TestProductValidationReportsAllErrors checks that a product body breaking several rules of productSchema
+// is rejected on create and update with every broken rule listed, in schema order.
+func TestProductValidationReportsAllErrors(t *testing.T) {
+	s := useStore(t)
+
+	body := `{"name":"  ","description":"` + strings.Repeat("x", 2001) + `","category":"Home","price":-1,"weight":2000,"tags":["fragile",""],"warehouse_id":"moon"}`
+	want := []FieldError{
+		{"name", "is required"},
+		{"description", "must be at most 2000 characters"},
+		{"price", "must be greater than 0"},
+		{"weight", "must be at most 1000"},
+		{"tags", "must be non-blank and at most 50 characters each"},
+		{"warehouse_id", "must be a configured warehouse"},
+	}
+
+	requests := map[string]func(*httptest.ResponseRecorder){
+		"create": func(rec *httptest.ResponseRecorder) {
+			handleCreateProduct(rec, httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body)))
+		},
+		"update": func(rec *httptest.ResponseRecorder) {
+			handleUpdateProduct(rec, httptest.NewRequest(http.MethodPut, "/products/1", strings.NewReader(body)), 1)
+		},
+	}
+	for name, do := range requests {
+		rec := httptest.NewRecorder()
+		do(rec)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want %d: %s", name, rec.Code, http.StatusBadRequest, rec.Body)
+		}
+		var got struct {
+			Errors []FieldError `json:"errors"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(got.Errors, want) {
+			t.Errorf("%s: errors %+v\nwant %+v", name, got.Errors, want)
+		}
+	}
+
+	if p, err := s.Get(context.Background(), 1); err != nil || p.Name != seedProducts[0].Name {
+		t.Errorf("product 1 after a rejected update: %+v, %v; want it unchanged", p, err)
+	}
+}
+
+// TestMaxTotalFeeCap checks that peak, weekend, dispatch and insurance surcharges stacking past
+// MAX_TOTAL_FEE are clamped to it and flagged, while quotes under the cap are left alone.
+func TestMaxTotalFeeCap(t *testing.T) {
+	useStore(t)
+	setClock(t, wednesdayAt(15, 0, 0).AddDate(0, 0, 3)) // Saturday, peak hours
+	prevCap, prevWeekend, prevDispatch := maxTotalFee, weekendSurcharge, offHoursDispatchSurcharge
+	maxTotalFee, weekendSurcharge, offHoursDispatchSurcharge = 0, 1500, 1000
+	t.Cleanup(func() { maxTotalFee, weekendSurcharge, offHoursDispatchSurcharge = prevCap, prevWeekend, prevDispatch })
+
+	const target = "/shipping-fee?product_id=11&speed=overnight&insured=true"
+	uncapped := getShippingFee(t, target)
+	b := uncapped.Breakdown
+	if b.PeakSurcharge == 0 || b.WeekendSurcharge == 0 || b.DispatchSurcharge == 0 || b.InsuranceFee == 0 {
+		t.Fatalf("breakdown %+v, want peak, weekend, dispatch and insurance surcharges stacked", b)
+	}
+
+	maxTotalFee = uncapped.ShippingFee - 1000
+	capped := getShippingFee(t, target)
+	if capped.ShippingFee != maxTotalFee || capped.Breakdown.Total != maxTotalFee || !capped.Breakdown.FeeCapped {
+		t.Errorf("fee %v, breakdown total %v, fee_capped %t; want both clamped to %v and flagged", capped.ShippingFee, capped.Breakdown.Total, capped.Breakdown.FeeCapped, maxTotalFee)
+	}
+
+	cheap := getShippingFee(t, "/shipping-fee?product_id=1")
+	if cheap.ShippingFee >= maxTotalFee || cheap.Breakdown.FeeCapped {
+		t.Errorf("fee %v, fee_capped %t; want an unflagged fee under the cap %v", cheap.ShippingFee, cheap.Breakdown.FeeCapped, maxTotalFee)
+	}
+
+	cart := getCart(t, "/shipping-fee?product_id=11&product_id=11&product_id=11&speed=overnight")
+	if cart.Total != maxTotalFee {
+		t.Errorf("cart total %v, want it clamped to %v", cart.Total, maxTotalFee)
+	}
+}
+
+// TestMultipleTagSurcharges checks that each configured tag on a product adds its surcharge once,
+// whatever its case, that the breakdown lists the tags that contributed, and that products return their tags.
+func TestMultipleTagSurcharges(t *testing.T) {
+	s := useStore(t)
+	setClock(t, wednesdayAt(9, 30, 0))
+	prev := tagSurcharges
+	tagSurcharges = map[string]Money{"fragile": 300, "hazmat": 1200, "perishable": 500}
+	t.Cleanup(func() { tagSurcharges = prev })
+
+	tags := []string{"Fragile", "hazmat", "gift", "fragile"}
+	tagged, err := s.Create(context.Background(), Product{Name: "Battery pack", Price: 30, Category: "Electronics", Weight: 1, Tags: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := s.Create(context.Background(), Product{Name: "Battery pack", Price: 30, Category: "Electronics", Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quote := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", tagged.ID))
+	base := getShippingFee(t, fmt.Sprintf("/shipping-fee?product_id=%d", plain.ID))
+	want := map[string]Money{"fragile": 300, "hazmat": 1200}
+	if quote.Breakdown.TagSurcharge != 1500 || !maps.Equal(quote.Breakdown.TagSurcharges, want) {
+		t.Errorf("tag surcharge %v from %v, want 15.00 from %v", quote.Breakdown.TagSurcharge, quote.Breakdown.TagSurcharges, want)
+	}
+	if base.Breakdown.TagSurcharge != 0 || quote.ShippingFee <= base.ShippingFee {
+		t.Errorf("fee %v tagged, %v untagged with tag surcharge %v; want the tags to add to the fee", quote.ShippingFee, base.ShippingFee, base.Breakdown.TagSurcharge)
+	}
+
+	rec := httptest.NewRecorder()
+	handleGetProduct(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/products/%d", tagged.ID), nil), tagged.ID)
+	var got Product
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Tags, tags) {
+		t.Errorf("product tags %v, want %v", got.Tags, tags)
+	}
+}
@@ -0,0 +1,140 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testSchema creates an empty Postgres schema for the rest of the test and returns a DSN
+// whose connections use it, so the tests never touch the products table in DATABASE_URL.
+func testSchema(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema := fmt.Sprintf("shipping_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping %s: %v", schema, err)
+		}
+	})
+
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// TestPostgresStoreCRUD checks that a new database is seeded and that products round-trip
+// through create, get, update, list and delete.
+func TestPostgresStoreCRUD(t *testing.T) {
+	ctx := context.Background()
+	s, err := newPostgresStore(ctx, testSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	list, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(seedProducts) {
+		t.Fatalf("%d products after seeding, want %d", len(list), len(seedProducts))
+	}
+
+	created, err := s.Create(ctx, Product{Name: "Lamp", Price: 25, Category: "Electronics", Weight: 1, StockQuantity: intPtr(4), Tags: []string{"fragile"}, WarehouseID: "secondary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID <= seedProducts[len(seedProducts)-1].ID {
+		t.Errorf("new product got ID %d, which collides with the seed IDs", created.ID)
+	}
+
+	got, err := s.Get(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Lamp" || got.StockQuantity == nil || *got.StockQuantity != 4 || !slices.Equal(got.Tags, []string{"fragile"}) || got.WarehouseID != "secondary" {
+		t.Errorf("got %+v, want the created product", got)
+	}
+
+	got.Price, got.StockQuantity, got.Tags = 30, nil, nil
+	updated, err := s.Update(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Price != 30 || updated.StockQuantity != nil || len(updated.Tags) != 0 {
+		t.Errorf("updated to %+v, want price 30, untracked stock and no tags", updated)
+	}
+
+	if err := s.Delete(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, created.ID); !errors.Is(err, errProductNotFound) {
+		t.Errorf("Get after Delete: %v, want errProductNotFound", err)
+	}
+	if err := s.Delete(ctx, created.ID); !errors.Is(err, errProductNotFound) {
+		t.Errorf("second Delete: %v, want errProductNotFound", err)
+	}
+}
+
+// TestPostgresStoreMigratesExistingTable checks that a table from the first schema version,
+// before dimensions, stock and tags, is migrated in place without being reseeded.
+func TestPostgresStoreMigratesExistingTable(t *testing.T) {
+	ctx := context.Background()
+	dsn := testSchema(t)
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(productsSchema[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO products (name, price, category, weight) VALUES ('Old Chair', 80, 'Furniture', 9)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// migrating twice must be as good as once
+	for i := 0; i < 2; i++ {
+		s, err := newPostgresStore(ctx, dsn)
+		if err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+		list, err := s.List(ctx)
+		s.db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 {
+			t.Fatalf("migration %d: %d products, want the 1 existing one", i+1, len(list))
+		}
+		if p := list[0]; p.Name != "Old Chair" || p.StockQuantity != nil || p.Oversized || len(p.Tags) != 0 || p.WarehouseID != "" {
+			t.Errorf("migration %d: got %+v, want the old row with the new columns at their defaults", i+1, p)
+		}
+	}
+}